@@ -0,0 +1,16 @@
+//go:build goexperiment.jsonv2
+
+package internal
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+)
+
+// PocketBase unmarshals collections through a pointer alias, which recurses endlessly with the
+// encoding/json of the jsonv2 experiment. Tests needing an app run with GOEXPERIMENT=nojsonv2.
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Skip("PocketBase cannot load collections with the jsonv2 experiment, run with GOEXPERIMENT=nojsonv2")
+	return nil
+}
@@ -0,0 +1,38 @@
+//go:build !goexperiment.jsonv2
+
+package internal
+
+import (
+	"testing"
+
+	_ "github.com/palacms/palacms/migrations"
+	"github.com/pocketbase/pocketbase"
+)
+
+// Bootstrap an app with all migrations applied in a temporary data directory
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+
+	pb := pocketbase.NewWithConfig(pocketbase.Config{
+		DefaultDataDir:  t.TempDir(),
+		HideStartBanner: true,
+	})
+	if err := pb.Bootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pb.ResetBootstrapState()
+	})
+
+	if err := pb.RunAllMigrations(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Logs are written in the background, which could race with removing the data directory
+	settings := pb.Settings()
+	settings.Logs.MaxDays = 0
+	if err := pb.Save(settings); err != nil {
+		t.Fatal(err)
+	}
+	return pb
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+func createTestRecord(t *testing.T, app core.App, collection string, values map[string]any) *core.Record {
+	t.Helper()
+
+	records, err := app.FindCollectionByNameOrId(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := core.NewRecord(records)
+	record.Load(values)
+	if err := app.Save(record); err != nil {
+		t.Fatalf("save %s: %v", collection, err)
+	}
+	return record
+}
+
+func testFile(t *testing.T, content string, name string) *filesystem.File {
+	t.Helper()
+
+	file, err := filesystem.NewFileFromBytes([]byte(content), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+type testSite struct {
+	site  *core.Record
+	home  *core.Record
+	about *core.Record
+}
+
+// Create a site with a home page and an about page below it
+func createTestSite(t *testing.T, app core.App) *testSite {
+	t.Helper()
+
+	group := createTestRecord(t, app, "site_groups", map[string]any{"name": "Group"})
+	site := createTestRecord(t, app, "sites", map[string]any{"name": "Site", "host": "example.com", "group": group.Id})
+	pageType := createTestRecord(t, app, "page_types", map[string]any{"name": "Default", "site": site.Id})
+	home := createTestRecord(t, app, "pages", map[string]any{
+		"name":          "Home",
+		"slug":          "",
+		"site":          site.Id,
+		"page_type":     pageType.Id,
+		"compiled_html": testFile(t, `<html><body><a href="/about">About</a></body></html>`, "index.html"),
+	})
+	about := createTestRecord(t, app, "pages", map[string]any{
+		"name":          "About",
+		"slug":          "about",
+		"site":          site.Id,
+		"page_type":     pageType.Id,
+		"parent":        home.Id,
+		"compiled_html": testFile(t, `<html><body>About</body></html>`, "index.html"),
+	})
+	return &testSite{site: site, home: home, about: about}
+}
+
+// Run a publish job for the site, failing the test unless it succeeds
+func publishTestSite(t *testing.T, pb *pocketbase.PocketBase, site *core.Record) *core.Record {
+	t.Helper()
+
+	job := createTestRecord(t, pb, "publish_jobs", map[string]any{"site": site.Id, "status": publishJobQueued})
+	runPublishJob(context.Background(), pb, job)
+	if job.GetString("status") != publishJobSucceeded {
+		t.Fatalf("publish job %s: %s", job.GetString("status"), job.GetString("error"))
+	}
+	return job
+}
+
+// Build the router of the app with the routes registered on serve
+func newTestHandler(t *testing.T, pb *pocketbase.PocketBase) http.Handler {
+	t.Helper()
+
+	router, err := apis.NewRouter(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serveEvent := &core.ServeEvent{App: pb, Router: router}
+	err = pb.OnServe().Trigger(serveEvent, func(serveEvent *core.ServeEvent) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux, err := router.BuildMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mux
+}
+
+func serveTestRequest(handler http.Handler, method string, target string, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
@@ -0,0 +1,607 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// Version of the bundle format, increased whenever older versions cannot import bundles
+const siteBundleVersion = 1
+
+// Largest bundle accepted by the import endpoint, and largest file read from a bundle
+const maxSiteBundleSize = 512 << 20
+
+// Name of the file describing the records in bundle archives, the files of the records are stored next to it
+const siteBundleFile = "site.json"
+
+// siteCollection is a collection holding content of sites
+type siteCollection struct {
+	name string
+	// Relation to the site or to a collection before this one, which the records belong to
+	owner string
+}
+
+// Collections belonging to a site in the order they are created, so that relations point to created records
+var siteCollections = []siteCollection{
+	{"site_fields", "site"},
+	{"site_entries", "field"},
+	{"site_symbols", "site"},
+	{"site_symbol_fields", "symbol"},
+	{"site_symbol_entries", "field"},
+	{"site_uploads", "site"},
+	{"page_types", "site"},
+	{"page_type_fields", "page_type"},
+	{"page_type_entries", "field"},
+	{"page_type_symbols", "page_type"},
+	{"page_type_sections", "page_type"},
+	{"page_type_section_entries", "section"},
+	{"pages", "site"},
+	{"page_entries", "page"},
+	{"page_sections", "page"},
+	{"page_section_entries", "section"},
+	{"site_feeds", "site"},
+	{"redirects", "site"},
+}
+
+// Fields that only make sense on the instance the site is on
+var siteBundleExcludedFields = map[string]bool{
+	"sites.release": true,
+}
+
+// Files referencing records by ID, which are rewritten along with the IDs
+var siteBundleRewrittenFiles = map[string]bool{
+	"pages.compiled_html":      true,
+	"site_symbols.compiled_js": true,
+}
+
+// siteBundle is a site and the records of its content, as stored in site archives
+type siteBundle struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	// Values of the records by collection name, the site being the only record of "sites".
+	// File fields hold the name of the file, stored as files/<collection>/<id>/<name>.
+	Records map[string][]map[string]any `json:"records"`
+}
+
+// Read a file of a bundled record
+type siteBundleFiles func(collection string, recordId string, name string) ([]byte, error)
+
+func siteBundleFilePath(collection string, recordId string, name string) string {
+	return "files/" + collection + "/" + recordId + "/" + name
+}
+
+// Values of the exported fields of a record in their JSON form
+func exportRecordValues(record *core.Record) map[string]any {
+	collection := record.Collection()
+	values := map[string]any{"id": record.Id}
+	for _, field := range collection.Fields {
+		name := field.GetName()
+		if name == "id" || field.GetHidden() || field.Type() == core.FieldTypeAutodate || siteBundleExcludedFields[collection.Name+"."+name] {
+			continue
+		}
+
+		switch value := record.Get(name).(type) {
+		case types.JSONRaw:
+			var decoded any
+			if err := json.Unmarshal(value, &decoded); err == nil {
+				values[name] = decoded
+			}
+		case types.DateTime:
+			values[name] = value.String()
+		default:
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// Gather the site and every record belonging to it
+func collectSiteBundle(app core.App, site *core.Record) (*siteBundle, error) {
+	bundle := &siteBundle{
+		Version:  siteBundleVersion,
+		Exported: time.Now().UTC(),
+		Records:  map[string][]map[string]any{"sites": {exportRecordValues(site)}},
+	}
+
+	ids := map[string][]any{"sites": {site.Id}}
+	for _, siteCollection := range siteCollections {
+		collection, err := app.FindCollectionByNameOrId(siteCollection.name)
+		if err != nil {
+			return nil, err
+		}
+
+		owner, ok := collection.Fields.GetByName(siteCollection.owner).(*core.RelationField)
+		if !ok {
+			return nil, fmt.Errorf("%s has no relation %q", collection.Name, siteCollection.owner)
+		}
+		ownerCollection, err := app.FindCollectionByNameOrId(owner.CollectionId)
+		if err != nil {
+			return nil, err
+		}
+
+		records, err := app.FindAllRecords(collection, dbx.In(siteCollection.owner, ids[ownerCollection.Name]...))
+		if err != nil {
+			return nil, err
+		}
+
+		bundle.Records[collection.Name] = []map[string]any{}
+		for _, record := range records {
+			ids[collection.Name] = append(ids[collection.Name], record.Id)
+			bundle.Records[collection.Name] = append(bundle.Records[collection.Name], exportRecordValues(record))
+		}
+	}
+
+	return bundle, nil
+}
+
+// Order records so that parents come before their children
+func sortByParent(records []map[string]any) []map[string]any {
+	sorted := make([]map[string]any, 0, len(records))
+	created := map[any]bool{"": true, nil: true}
+	remaining := records
+	for len(remaining) > 0 {
+		next := []map[string]any{}
+		for _, values := range remaining {
+			if created[values["parent"]] {
+				sorted = append(sorted, values)
+				created[values["id"]] = true
+			} else {
+				next = append(next, values)
+			}
+		}
+		if len(next) == len(remaining) {
+			// Parents are missing or form a cycle, which saving the records reports
+			return append(sorted, next...)
+		}
+		remaining = next
+	}
+	return sorted
+}
+
+// Replace the IDs in the strings of a value
+func rewriteIds(value any, ids *strings.Replacer) any {
+	switch value := value.(type) {
+	case string:
+		return ids.Replace(value)
+	case []string:
+		rewritten := make([]string, len(value))
+		for index, item := range value {
+			rewritten[index] = ids.Replace(item)
+		}
+		return rewritten
+	case []any:
+		rewritten := make([]any, len(value))
+		for index, item := range value {
+			rewritten[index] = rewriteIds(item, ids)
+		}
+		return rewritten
+	case map[string]any:
+		rewritten := make(map[string]any, len(value))
+		for key, item := range value {
+			rewritten[key] = rewriteIds(item, ids)
+		}
+		return rewritten
+	}
+	return value
+}
+
+// Create a new site from a bundle with new IDs for all of its records, applying the overrides to the values
+// of the site. Every ID of the bundle is replaced in the values and rewritten files of the records, so that
+// references to records of the site in entries and compiled pages point to the new records.
+func createSiteFromBundle(app core.App, bundle *siteBundle, files siteBundleFiles, overrides map[string]any) (*core.Record, error) {
+	if bundle.Version < 1 || bundle.Version > siteBundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+	if len(bundle.Records["sites"]) != 1 {
+		return nil, errors.New("bundle has to contain exactly one site")
+	}
+
+	order := []string{"sites"}
+	for _, siteCollection := range siteCollections {
+		order = append(order, siteCollection.name)
+	}
+
+	replacements := []string{}
+	for _, name := range order {
+		for _, values := range bundle.Records[name] {
+			id, _ := values["id"].(string)
+			if id == "" {
+				return nil, fmt.Errorf("record of %s has no ID", name)
+			}
+			replacements = append(replacements, id, core.GenerateDefaultRandomId())
+		}
+	}
+	ids := strings.NewReplacer(replacements...)
+
+	// Relations to records created later are set once they are
+	type deferredRelation struct {
+		record *core.Record
+		field  string
+		value  any
+	}
+	deferred := []deferredRelation{}
+
+	var site *core.Record
+	for position, name := range order {
+		collection, err := app.FindCollectionByNameOrId(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, values := range sortByParent(bundle.Records[name]) {
+			oldId := values["id"].(string)
+			record := core.NewRecord(collection)
+			record.Set("id", ids.Replace(oldId))
+
+			for _, field := range collection.Fields {
+				fieldName := field.GetName()
+				value, ok := values[fieldName]
+				if !ok || fieldName == "id" || field.GetHidden() || field.Type() == core.FieldTypeAutodate || siteBundleExcludedFields[name+"."+fieldName] {
+					continue
+				}
+
+				switch field := field.(type) {
+				case *core.FileField:
+					fileName, _ := value.(string)
+					if fileName == "" {
+						continue
+					}
+
+					data, err := files(name, oldId, fileName)
+					if err != nil {
+						return nil, fmt.Errorf("file %s of %s: %w", fileName, name, err)
+					}
+					if siteBundleRewrittenFiles[name+"."+fieldName] {
+						data = []byte(ids.Replace(string(data)))
+					}
+
+					file, err := filesystem.NewFileFromBytes(data, fileName)
+					if err != nil {
+						return nil, err
+					}
+					// Published pages reference files by their stored name
+					file.Name = fileName
+					record.Set(fieldName, file)
+
+				case *core.RelationField:
+					value = rewriteIds(value, ids)
+					target, err := app.FindCollectionByNameOrId(field.CollectionId)
+					if err != nil {
+						return nil, err
+					}
+					if slices.Index(order, target.Name) > position {
+						deferred = append(deferred, deferredRelation{record, fieldName, value})
+						continue
+					}
+					record.Set(fieldName, value)
+
+				default:
+					record.Set(fieldName, rewriteIds(value, ids))
+				}
+			}
+
+			if name == "sites" {
+				for key, value := range overrides {
+					record.Set(key, value)
+				}
+				site = record
+			}
+
+			if err := app.Save(record); err != nil {
+				return nil, fmt.Errorf("failed to create record of %s: %w", name, err)
+			}
+		}
+	}
+
+	for _, relation := range deferred {
+		relation.record.Set(relation.field, relation.value)
+		if err := app.Save(relation.record); err != nil {
+			return nil, fmt.Errorf("failed to update record of %s: %w", relation.record.Collection().Name, err)
+		}
+	}
+
+	return site, nil
+}
+
+// Write the bundle of a site as a zip archive
+func writeSiteArchive(app core.App, fs *filesystem.System, site *core.Record, writer io.Writer) error {
+	bundle, err := collectSiteBundle(app, site)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(writer)
+	entry, err := archive.Create(siteBundleFile)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(entry).Encode(bundle); err != nil {
+		return err
+	}
+
+	for name, records := range bundle.Records {
+		collection, err := app.FindCollectionByNameOrId(name)
+		if err != nil {
+			return err
+		}
+
+		for _, values := range records {
+			for _, field := range collection.Fields {
+				fileName, _ := values[field.GetName()].(string)
+				if field.Type() != core.FieldTypeFile || fileName == "" {
+					continue
+				}
+
+				recordId := values["id"].(string)
+				reader, err := fs.GetReader(collection.Id + "/" + recordId + "/" + fileName)
+				if err != nil {
+					return fmt.Errorf("file %s of %s: %w", fileName, name, err)
+				}
+
+				entry, err := archive.Create(siteBundleFilePath(name, recordId, fileName))
+				if err == nil {
+					_, err = io.Copy(entry, reader)
+				}
+				reader.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+// Read a site archive, returning the bundle and a reader for the files in it
+func readSiteArchive(data []byte) (*siteBundle, siteBundleFiles, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a site archive: %w", err)
+	}
+
+	readEntry := func(name string) ([]byte, error) {
+		entry, err := archive.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer entry.Close()
+
+		data, err := io.ReadAll(io.LimitReader(entry, maxSiteBundleSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxSiteBundleSize {
+			return nil, fmt.Errorf("%s is too large", name)
+		}
+		return data, nil
+	}
+
+	manifest, err := readEntry(siteBundleFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a site archive: %w", err)
+	}
+
+	bundle := &siteBundle{}
+	if err := json.Unmarshal(manifest, bundle); err != nil {
+		return nil, nil, fmt.Errorf("not a site archive: %w", err)
+	}
+
+	files := func(collection string, recordId string, name string) ([]byte, error) {
+		return readEntry(siteBundleFilePath(collection, recordId, name))
+	}
+	return bundle, files, nil
+}
+
+// Values of the imported site replacing the ones of the bundle, where the name is kept unless given
+func siteImportOverrides(group *core.Record, name string, host string) map[string]any {
+	overrides := map[string]any{
+		"group": group.Id,
+		"host":  host,
+	}
+	if name != "" {
+		overrides["name"] = name
+	}
+	return overrides
+}
+
+func RegisterSiteBundles(pb *pocketbase.PocketBase) error {
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		serveEvent.Router.GET("/api/palacms/sites/{id}/export", func(requestEvent *core.RequestEvent) error {
+			site, err := pb.FindRecordById("sites", requestEvent.Request.PathValue("id"))
+			if err != nil {
+				return requestEvent.NotFoundError("", err)
+			}
+
+			info, err := requestEvent.RequestInfo()
+			if err != nil {
+				return err
+			}
+
+			canAccess, err := requestEvent.App.CanAccessRecord(site, info, site.Collection().ViewRule)
+			if !canAccess {
+				return requestEvent.ForbiddenError("", err)
+			}
+
+			fs, err := pb.NewFilesystem()
+			if err != nil {
+				return err
+			}
+			defer fs.Close()
+
+			// Written to a buffer first, so that failures are answered with an error instead of a broken archive
+			var archive bytes.Buffer
+			if err := writeSiteArchive(pb, fs, site, &archive); err != nil {
+				return err
+			}
+
+			header := requestEvent.Response.Header()
+			header.Set("Content-Disposition", `attachment; filename="`+site.GetString("host")+`.zip"`)
+			header.Set("Cache-Control", "no-store")
+			return requestEvent.Blob(200, "application/zip", archive.Bytes())
+		})
+
+		serveEvent.Router.POST("/api/palacms/sites/import", func(requestEvent *core.RequestEvent) error {
+			uploads, err := requestEvent.FindUploadedFiles("bundle")
+			if err != nil || len(uploads) != 1 {
+				return requestEvent.BadRequestError("bundle missing", err)
+			}
+
+			groupId := requestEvent.Request.FormValue("group")
+			host := requestEvent.Request.FormValue("host")
+			if groupId == "" || host == "" {
+				return requestEvent.BadRequestError("group and host are required", nil)
+			}
+
+			group, err := pb.FindRecordById("site_groups", groupId)
+			if err != nil {
+				return requestEvent.BadRequestError("group does not exist", err)
+			}
+
+			reader, err := uploads[0].Reader.Open()
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+
+			bundle, files, err := readSiteArchive(data)
+			if err != nil {
+				return requestEvent.BadRequestError(err.Error(), nil)
+			}
+
+			info, err := requestEvent.RequestInfo()
+			if err != nil {
+				return err
+			}
+
+			var site *core.Record
+			err = pb.RunInTransaction(func(txApp core.App) error {
+				created, err := createSiteFromBundle(txApp, bundle, files, siteImportOverrides(group, requestEvent.Request.FormValue("name"), host))
+				if err != nil {
+					return requestEvent.BadRequestError(err.Error(), err)
+				}
+				site = created
+
+				// The site only exists within the transaction, which is rolled back unless the user can create it
+				canAccess, err := txApp.CanAccessRecord(created, info, created.Collection().CreateRule)
+				if !canAccess {
+					return requestEvent.ForbiddenError("", err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return requestEvent.JSON(200, struct {
+				SiteId string `json:"site_id"`
+			}{SiteId: site.Id})
+		}).Bind(apis.BodyLimit(maxSiteBundleSize))
+
+		return serveEvent.Next()
+	})
+
+	exportCommand := &cobra.Command{
+		Use:   "export <site id or host> [file]",
+		Short: "Export a site to a bundle archive",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE: func(command *cobra.Command, args []string) error {
+			site, err := findRecordByIdOrField(pb, "sites", "host", args[0])
+			if err != nil {
+				return fmt.Errorf("site %q not found", args[0])
+			}
+
+			fileName := site.GetString("host") + ".zip"
+			if len(args) == 2 {
+				fileName = args[1]
+			}
+
+			fs, err := pb.NewFilesystem()
+			if err != nil {
+				return err
+			}
+			defer fs.Close()
+
+			file, err := os.Create(fileName)
+			if err != nil {
+				return err
+			}
+			if err := writeSiteArchive(pb, fs, site, file); err != nil {
+				file.Close()
+				os.Remove(fileName)
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+
+			command.Printf("Exported %s to %s\n", site.GetString("host"), fileName)
+			return nil
+		},
+	}
+
+	var groupName, siteName, host string
+	importCommand := &cobra.Command{
+		Use:   "import <file>",
+		Short: "Create a site from a bundle archive",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			group, err := findRecordByIdOrField(pb, "site_groups", "name", groupName)
+			if err != nil {
+				return fmt.Errorf("group %q not found", groupName)
+			}
+
+			data, err := os.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+
+			bundle, files, err := readSiteArchive(data)
+			if err != nil {
+				return err
+			}
+
+			var site *core.Record
+			err = pb.RunInTransaction(func(txApp core.App) error {
+				created, err := createSiteFromBundle(txApp, bundle, files, siteImportOverrides(group, siteName, host))
+				site = created
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			command.Printf("Imported %s from %s as site %s\n", site.GetString("host"), path.Base(args[0]), site.Id)
+			return nil
+		},
+	}
+	importCommand.Flags().StringVar(&groupName, "group", "", "ID or name of the group to add the site to")
+	importCommand.Flags().StringVar(&host, "host", "", "host of the imported site")
+	importCommand.Flags().StringVar(&siteName, "name", "", "name of the imported site, the exported name by default")
+	importCommand.MarkFlagRequired("group")
+	importCommand.MarkFlagRequired("host")
+
+	sitesCommand(pb).AddCommand(exportCommand, importCommand)
+	return nil
+}
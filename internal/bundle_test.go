@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+)
+
+func TestSortByParent(t *testing.T) {
+	record := func(id string, parent any) map[string]any {
+		return map[string]any{"id": id, "parent": parent}
+	}
+
+	tests := []struct {
+		name    string
+		records []map[string]any
+		want    []string
+	}{
+		{"empty", []map[string]any{}, []string{}},
+		{"without parents", []map[string]any{record("a", ""), record("b", nil), {"id": "c"}}, []string{"a", "b", "c"}},
+		{"sorted", []map[string]any{record("a", ""), record("b", "a"), record("c", "b")}, []string{"a", "b", "c"}},
+		{"reversed", []map[string]any{record("c", "b"), record("b", "a"), record("a", "")}, []string{"a", "b", "c"}},
+		{"children after their parent", []map[string]any{record("y", "a"), record("a", ""), record("x", "a")}, []string{"a", "x", "y"}},
+		{"missing parent last", []map[string]any{record("b", "missing"), record("a", "")}, []string{"a", "b"}},
+		{"cycle last", []map[string]any{record("b", "c"), record("c", "b"), record("a", ""), record("d", "a")}, []string{"a", "d", "b", "c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ids := []string{}
+			for _, values := range sortByParent(test.records) {
+				ids = append(ids, values["id"].(string))
+			}
+			if !slices.Equal(ids, test.want) {
+				t.Errorf("sortByParent() = %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestSiteArchiveRoundTrip(t *testing.T) {
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	// Compiled pages refer to records of the site by ID
+	fixture.home.Set("compiled_html", testFile(t, `<html><body data-page="`+fixture.about.Id+`"></body></html>`, "index.html"))
+	if err := pb.Save(fixture.home); err != nil {
+		t.Fatal(err)
+	}
+
+	system, err := pb.NewFilesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.Close()
+
+	var archive bytes.Buffer
+	if err := writeSiteArchive(pb, system, fixture.site, &archive); err != nil {
+		t.Fatal(err)
+	}
+	bundle, files, err := readSiteArchive(archive.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := createTestRecord(t, pb, "site_groups", map[string]any{"name": "Imported"})
+	site, err := createSiteFromBundle(pb, bundle, files, siteImportOverrides(group, "", "copy.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site.Id == fixture.site.Id || site.GetString("name") != "Site" || site.GetString("host") != "copy.example.com" || site.GetString("group") != group.Id {
+		t.Errorf("imported site = %v", site)
+	}
+
+	home, err := pb.FindFirstRecordByFilter("pages", "site = {:site} && slug = ''", dbx.Params{"site": site.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	about, err := pb.FindFirstRecordByFilter("pages", "site = {:site} && slug = 'about'", dbx.Params{"site": site.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if about.GetString("parent") != home.Id {
+		t.Errorf("parent of the imported about page = %q, want the imported home page %q", about.GetString("parent"), home.Id)
+	}
+
+	reader, err := system.GetReader(home.BaseFilesPath() + "/" + home.GetString("compiled_html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	html, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(html), about.Id) || strings.Contains(string(html), fixture.about.Id) {
+		t.Errorf("compiled home page = %q, want it to refer to the imported about page %s", html, about.Id)
+	}
+}
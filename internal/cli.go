@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/spf13/cobra"
+)
+
+// Roles of users, both on the server and on single sites
+var userRoles = []string{"editor", "developer"}
+
+// Find a record by ID, or by the value of a field identifying it
+func findRecordByIdOrField(app core.App, collection string, field string, value string) (*core.Record, error) {
+	if record, err := app.FindRecordById(collection, value); err == nil {
+		return record, nil
+	}
+	return app.FindFirstRecordByData(collection, field, value)
+}
+
+// Apply migrations before running the command like the server does, so that it works on new installations
+func migrateBeforeRun(pb *pocketbase.PocketBase, command *cobra.Command) *cobra.Command {
+	command.PersistentPreRunE = func(command *cobra.Command, args []string) error {
+		return pb.RunAllMigrations()
+	}
+	return command
+}
+
+// Return the "sites" command of the CLI, adding it on first use
+func sitesCommand(pb *pocketbase.PocketBase) *cobra.Command {
+	for _, command := range pb.RootCmd.Commands() {
+		if command.Name() == "sites" {
+			return command
+		}
+	}
+
+	command := migrateBeforeRun(pb, &cobra.Command{
+		Use:   "sites",
+		Short: "Manage the sites of PalaCMS",
+	})
+	pb.RootCmd.AddCommand(command)
+	return command
+}
+
+func validateUserRole(role string) error {
+	if !slices.Contains(userRoles, role) {
+		return fmt.Errorf("role has to be one of %v", userRoles)
+	}
+	return nil
+}
+
+// Give the user the role on the site, replacing any role the user already has on it
+func assignSiteRole(app core.App, site *core.Record, user *core.Record, role string) (*core.Record, error) {
+	assignment, err := app.FindFirstRecordByFilter(
+		"site_role_assignments",
+		"site = {:site} && user = {:user}",
+		dbx.Params{"site": site.Id, "user": user.Id},
+	)
+	if err != nil {
+		collection, err := app.FindCollectionByNameOrId("site_role_assignments")
+		if err != nil {
+			return nil, err
+		}
+
+		assignment = core.NewRecord(collection)
+		assignment.Set("site", site.Id)
+		assignment.Set("user", user.Id)
+	}
+
+	assignment.Set("role", role)
+	if err := app.Save(assignment); err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
+
+func sitesListCommand(pb *pocketbase.PocketBase) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the sites with their groups and releases",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			sites, err := pb.FindRecordsByFilter("sites", "", "index,created", 0, 0)
+			if err != nil {
+				return err
+			}
+			groups, err := pb.FindAllRecords("site_groups")
+			if err != nil {
+				return err
+			}
+			groupNames := map[string]string{}
+			for _, group := range groups {
+				groupNames[group.Id] = group.GetString("name")
+			}
+
+			writer := tabwriter.NewWriter(command.OutOrStdout(), 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "ID\tHOST\tNAME\tGROUP\tRELEASE")
+			for _, site := range sites {
+				group := groupNames[site.GetString("group")]
+				release := site.GetString("release")
+				if release == "" {
+					release = "-"
+				}
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", site.Id, site.GetString("host"), site.GetString("name"), group, release)
+			}
+			return writer.Flush()
+		},
+	}
+}
+
+func publishCommand(pb *pocketbase.PocketBase) *cobra.Command {
+	var siteArg, pageId string
+	var includeChildren, dryRun bool
+
+	command := &cobra.Command{
+		Use:   "publish",
+		Short: "Publish a site, or a page of it, and wait for it to finish",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			site, err := findRecordByIdOrField(pb, "sites", "host", siteArg)
+			if err != nil {
+				return fmt.Errorf("site %q not found", siteArg)
+			}
+
+			scope, err := newPublishScope(pb, site, pageId, includeChildren)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(command.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			if dryRun {
+				plan, err := planSite(ctx, pb, site, scope)
+				if err != nil {
+					return err
+				}
+
+				encoder := json.NewEncoder(command.OutOrStdout())
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(plan)
+			}
+
+			job, err := createPublishJob(pb, site, scope)
+			if err != nil {
+				return err
+			}
+
+			command.Printf("Publishing %s as job %s\n", site.GetString("host"), job.Id)
+			runPublishJob(ctx, pb, job)
+
+			switch job.GetString("status") {
+			case publishJobSucceeded:
+				command.Printf("Published %s\n", site.GetString("host"))
+				return nil
+			case publishJobFailed:
+				return fmt.Errorf("publishing %s failed: %s", site.GetString("host"), job.GetString("error"))
+			default:
+				return fmt.Errorf("publishing %s was interrupted, job %s is resumed when the server starts", site.GetString("host"), job.Id)
+			}
+		},
+	}
+	command.Flags().StringVar(&siteArg, "site", "", "ID or host of the site to publish")
+	command.Flags().StringVar(&pageId, "page", "", "ID of a single page to publish, the whole site by default")
+	command.Flags().BoolVar(&includeChildren, "include-children", false, "publish the child pages of the page as well")
+	command.Flags().BoolVar(&dryRun, "dry-run", false, "print what would be published without publishing")
+	command.MarkFlagRequired("site")
+
+	return command
+}
+
+func usersCommand(pb *pocketbase.PocketBase) *cobra.Command {
+	var password, name, role string
+
+	createCommand := &cobra.Command{
+		Use:   "create <email>",
+		Short: "Create a user, printing a generated password unless one is given",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(command *cobra.Command, args []string) error {
+			if role != "" {
+				if err := validateUserRole(role); err != nil {
+					return err
+				}
+			}
+
+			collection, err := pb.FindCollectionByNameOrId("users")
+			if err != nil {
+				return err
+			}
+
+			generated := password == ""
+			if generated {
+				password = security.RandomString(20)
+			}
+
+			user := core.NewRecord(collection)
+			user.SetEmail(args[0])
+			user.SetPassword(password)
+			user.SetVerified(true)
+			user.Set("name", name)
+			user.Set("serverRole", role)
+			if err := pb.Save(user); err != nil {
+				return err
+			}
+
+			command.Printf("Created user %s with ID %s\n", user.Email(), user.Id)
+			if generated {
+				command.Printf("Password: %s\n", password)
+			}
+			return nil
+		},
+	}
+	createCommand.Flags().StringVar(&password, "password", "", "password of the user, generated by default")
+	createCommand.Flags().StringVar(&name, "name", "", "name of the user")
+	createCommand.Flags().StringVar(&role, "role", "", "role of the user on all sites, editor or developer")
+
+	command := &cobra.Command{
+		Use:   "users",
+		Short: "Manage the users of PalaCMS",
+	}
+	command.AddCommand(createCommand)
+	return command
+}
+
+func assignCommand(pb *pocketbase.PocketBase) *cobra.Command {
+	var siteArg, userArg, role string
+
+	command := &cobra.Command{
+		Use:   "assign",
+		Short: "Give a user a role on a site",
+		Args:  cobra.NoArgs,
+		RunE: func(command *cobra.Command, args []string) error {
+			if err := validateUserRole(role); err != nil {
+				return err
+			}
+
+			site, err := findRecordByIdOrField(pb, "sites", "host", siteArg)
+			if err != nil {
+				return fmt.Errorf("site %q not found", siteArg)
+			}
+
+			user, err := findRecordByIdOrField(pb, "users", "email", userArg)
+			if err != nil {
+				return fmt.Errorf("user %q not found", userArg)
+			}
+
+			if _, err := assignSiteRole(pb, site, user, role); err != nil {
+				return err
+			}
+
+			command.Printf("Assigned %s as %s of %s\n", user.Email(), role, site.GetString("host"))
+			return nil
+		},
+	}
+	command.Flags().StringVar(&siteArg, "site", "", "ID or host of the site")
+	command.Flags().StringVar(&userArg, "user", "", "ID or email of the user")
+	command.Flags().StringVar(&role, "role", "", "role of the user on the site, editor or developer")
+	command.MarkFlagRequired("site")
+	command.MarkFlagRequired("user")
+	command.MarkFlagRequired("role")
+
+	return command
+}
+
+// Add commands for running PalaCMS headlessly, such as from scripts and CI pipelines
+func RegisterCommands(pb *pocketbase.PocketBase) error {
+	sitesCommand(pb).AddCommand(sitesListCommand(pb))
+	pb.RootCmd.AddCommand(
+		migrateBeforeRun(pb, publishCommand(pb)),
+		migrateBeforeRun(pb, usersCommand(pb)),
+		migrateBeforeRun(pb, assignCommand(pb)),
+	)
+	return nil
+}
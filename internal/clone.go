@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"io"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+// Read the files of records from storage, for bundles collected on this instance
+func storedSiteBundleFiles(app core.App, fs *filesystem.System) siteBundleFiles {
+	return func(collectionName string, recordId string, name string) ([]byte, error) {
+		collection, err := app.FindCollectionByNameOrId(collectionName)
+		if err != nil {
+			return nil, err
+		}
+
+		reader, err := fs.GetReader(collection.Id + "/" + recordId + "/" + name)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		return io.ReadAll(reader)
+	}
+}
+
+// Copy a site and all of its content to a new site, with the overrides applied to its values
+func cloneSite(app core.App, fs *filesystem.System, site *core.Record, overrides map[string]any) (*core.Record, error) {
+	bundle, err := collectSiteBundle(app, site)
+	if err != nil {
+		return nil, err
+	}
+
+	return createSiteFromBundle(app, bundle, storedSiteBundleFiles(app, fs), overrides)
+}
+
+func RegisterSiteClone(pb *pocketbase.PocketBase) error {
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		serveEvent.Router.POST("/api/palacms/sites/{id}/clone", func(requestEvent *core.RequestEvent) error {
+			body := struct {
+				Host string `json:"host"`
+				// Name of the new site, the name of the cloned site followed by "copy" by default
+				Name string `json:"name"`
+				// Group of the new site, the group of the cloned site by default
+				GroupId string `json:"group_id"`
+			}{}
+			if err := requestEvent.BindBody(&body); err != nil {
+				return err
+			}
+			if body.Host == "" {
+				return requestEvent.BadRequestError("host missing", nil)
+			}
+
+			site, err := pb.FindRecordById("sites", requestEvent.Request.PathValue("id"))
+			if err != nil {
+				return requestEvent.NotFoundError("", err)
+			}
+
+			info, err := requestEvent.RequestInfo()
+			if err != nil {
+				return err
+			}
+
+			canAccess, err := requestEvent.App.CanAccessRecord(site, info, site.Collection().ViewRule)
+			if !canAccess {
+				return requestEvent.ForbiddenError("", err)
+			}
+
+			overrides := map[string]any{
+				"host": body.Host,
+				"name": site.GetString("name") + " copy",
+			}
+			if body.Name != "" {
+				overrides["name"] = body.Name
+			}
+			if body.GroupId != "" {
+				group, err := pb.FindRecordById("site_groups", body.GroupId)
+				if err != nil {
+					return requestEvent.BadRequestError("group_id does not exist", err)
+				}
+				overrides["group"] = group.Id
+			}
+
+			fs, err := pb.NewFilesystem()
+			if err != nil {
+				return err
+			}
+			defer fs.Close()
+
+			var clone *core.Record
+			err = pb.RunInTransaction(func(txApp core.App) error {
+				created, err := cloneSite(txApp, fs, site, overrides)
+				if err != nil {
+					return requestEvent.BadRequestError(err.Error(), err)
+				}
+				clone = created
+
+				// The site only exists within the transaction, which is rolled back unless the user can create it
+				canAccess, err := txApp.CanAccessRecord(created, info, created.Collection().CreateRule)
+				if !canAccess {
+					return requestEvent.ForbiddenError("", err)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			return requestEvent.JSON(200, struct {
+				SiteId string `json:"site_id"`
+			}{SiteId: clone.Id})
+		})
+
+		return serveEvent.Next()
+	})
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Files smaller than this are not worth compressing
+const minCompressedSize = 512
+
+// Content encodings of precompressed variants in order of preference, with the suffix of their file keys
+var fileEncodings = []struct {
+	name   string
+	suffix string
+}{
+	{name: "br", suffix: ".br"},
+	{name: "gzip", suffix: ".gz"},
+}
+
+func encodingSuffix(encoding string) string {
+	for _, fileEncoding := range fileEncodings {
+		if fileEncoding.name == encoding {
+			return fileEncoding.suffix
+		}
+	}
+	return ""
+}
+
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	switch encoding {
+	case "br":
+		writer := brotli.NewWriterLevel(&buffer, brotli.BestCompression)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+	case "gzip":
+		writer, err := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Compress text content into the encodings that make it smaller. Whether content is
+// compressed only depends on the content itself, so files with the same hash always
+// have the same variants.
+func compressVariants(data []byte) (map[string][]byte, error) {
+	variants := map[string][]byte{}
+	if len(data) < minCompressedSize || !strings.HasPrefix(http.DetectContentType(data), "text/") {
+		return variants, nil
+	}
+
+	for _, fileEncoding := range fileEncodings {
+		compressed, err := compress(fileEncoding.name, data)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			variants[fileEncoding.name] = compressed
+		}
+	}
+
+	return variants, nil
+}
+
+// Pick the preferred encoding accepted by the client
+func negotiateEncoding(acceptEncoding string, available []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			quality, _ = strconv.ParseFloat(value, 64)
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = quality > 0
+	}
+
+	for _, fileEncoding := range fileEncodings {
+		for _, encoding := range available {
+			if encoding != fileEncoding.name {
+				continue
+			}
+			if isAccepted, listed := accepted[encoding]; isAccepted || !listed && accepted["*"] {
+				return encoding
+			}
+		}
+	}
+	return ""
+}
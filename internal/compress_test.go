@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		available      []string
+		want           string
+	}{
+		{"no header", "", []string{"br", "gzip"}, ""},
+		{"no variants", "br, gzip", []string{}, ""},
+		{"brotli preferred", "gzip, br", []string{"br", "gzip"}, "br"},
+		{"only gzip accepted", "gzip, deflate", []string{"br", "gzip"}, "gzip"},
+		{"only gzip stored", "br, gzip", []string{"gzip"}, "gzip"},
+		{"case and spaces", " GZIP ;q=0.5 ", []string{"gzip"}, "gzip"},
+		{"quality is not a preference", "br;q=0.1, gzip;q=1", []string{"br", "gzip"}, "br"},
+		{"q=0 refuses", "br;q=0, gzip", []string{"br", "gzip"}, "gzip"},
+		{"q=0.0 refuses", "br;q=0.0, gzip;q=0", []string{"br", "gzip"}, ""},
+		{"wildcard", "*", []string{"br", "gzip"}, "br"},
+		{"wildcard with refused encoding", "br;q=0, *", []string{"br", "gzip"}, "gzip"},
+		{"refused wildcard", "*;q=0", []string{"br", "gzip"}, ""},
+		{"refused wildcard with listed encoding", "*;q=0, gzip", []string{"br", "gzip"}, "gzip"},
+		{"unknown encodings", "zstd, identity", []string{"br", "gzip"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := negotiateEncoding(test.acceptEncoding, test.available); got != test.want {
+				t.Errorf("negotiateEncoding(%q, %v) = %q, want %q", test.acceptEncoding, test.available, got, test.want)
+			}
+		})
+	}
+}
+
+func TestServeSitesNegotiatesEncoding(t *testing.T) {
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	html := "<html><body>" + strings.Repeat("<p>Compressible content</p>", 100) + "</body></html>"
+	fixture.home.Set("compiled_html", testFile(t, html, "index.html"))
+	if err := pb.Save(fixture.home); err != nil {
+		t.Fatal(err)
+	}
+	publishTestSite(t, pb, fixture.site)
+
+	if err := ServeSites(pb); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, pb)
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip, br", "br", func(reader io.Reader) (io.Reader, error) { return brotli.NewReader(reader), nil }},
+		{"gzip", "gzip", func(reader io.Reader) (io.Reader, error) { return gzip.NewReader(reader) }},
+		{"", "", func(reader io.Reader) (io.Reader, error) { return reader, nil }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.acceptEncoding, func(t *testing.T) {
+			response := serveTestRequest(handler, "GET", "http://example.com/", http.Header{"Accept-Encoding": {test.acceptEncoding}})
+			if response.Code != 200 {
+				t.Fatalf("status = %d, want 200", response.Code)
+			}
+			if got := response.Header().Get("Content-Encoding"); got != test.want {
+				t.Errorf("Content-Encoding = %q, want %q", got, test.want)
+			}
+			if got := response.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if got := response.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+				t.Errorf("Content-Type = %q, want text/html", got)
+			}
+
+			reader, err := test.decode(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != html {
+				t.Errorf("decoded body differs from the page: %.100q", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	deploySucceeded = "succeeded"
+	deployFailed    = "failed"
+)
+
+// deployer writes the files of a release to a deploy target
+type deployer interface {
+	upload(filePath string, data []byte) error
+	remove(filePath string) error
+	// Complete the deploy after all files have been written, e.g. by committing them
+	finish(release *core.Record) error
+	// Release connections and temporary files, whether or not the deploy was finished
+	close() error
+}
+
+// Creates a deployer from the configuration of a deploy target
+type deployerFactory func(ctx context.Context, target *core.Record) (deployer, error)
+
+// Deployers by deploy target type
+var deployers = map[string]deployerFactory{
+	"directory": newDirectoryDeployer,
+	"sftp":      newSftpDeployer,
+	"git":       newGitDeployer,
+	"s3":        newS3Deployer,
+}
+
+// Sync the release to every enabled deploy target of the site, recording the outcome on each target.
+// Failing targets do not fail the publish, since the release is already live.
+func deployRelease(p *publication, release *core.Record) error {
+	targets, err := p.pb.FindRecordsByFilter(
+		"deploy_targets",
+		"site = {:site} && enabled = true",
+		"created",
+		0,
+		0,
+		dbx.Params{"site": p.site.Id},
+	)
+	if err != nil {
+		return err
+	}
+
+	p.begin("deploy", len(targets)*len(p.manifest))
+	for _, target := range targets {
+		err := deployTarget(p, target, release)
+		if err != nil && p.ctx.Err() != nil {
+			return err
+		}
+
+		if err != nil {
+			p.pb.Logger().Warn("Deploy failed", "target", target.Id, "site", p.site.Id, "error", err)
+		}
+
+		// The target may have been edited or deleted while deploying
+		stored, findErr := p.pb.FindRecordById("deploy_targets", target.Id)
+		if findErr != nil {
+			continue
+		}
+
+		stored.Set("deployed", types.NowDateTime())
+		if err != nil {
+			stored.Set("status", deployFailed)
+			stored.Set("error", err.Error())
+		} else {
+			stored.Set("status", deploySucceeded)
+			stored.Set("error", "")
+			if !deployLocationChanged(target, stored) {
+				stored.Set("release", release.Id)
+			}
+		}
+		if err := p.pb.Save(stored); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Whether the target writes to another service or location than before, which has none of the files deployed before
+func deployLocationChanged(before *core.Record, after *core.Record) bool {
+	return before.GetString("type") != after.GetString("type") || before.GetString("config") != after.GetString("config")
+}
+
+// Forget the release deployed to targets moved to another location, so that every file is deployed there
+func RegisterDeployTargets(pb *pocketbase.PocketBase) error {
+	pb.OnRecordUpdate("deploy_targets").BindFunc(func(event *core.RecordEvent) error {
+		if deployLocationChanged(event.Record.Original(), event.Record) {
+			event.Record.Set("release", "")
+		}
+		return event.Next()
+	})
+
+	return nil
+}
+
+func deployTarget(p *publication, target *core.Record, release *core.Record) error {
+	newDeployer, ok := deployers[target.GetString("type")]
+	if !ok {
+		return fmt.Errorf("unknown deploy target type %q", target.GetString("type"))
+	}
+
+	// Only the changes since the release last deployed to the target are written
+	deployed := publishManifest{}
+	if releaseId := target.GetString("release"); releaseId != "" {
+		if previous, err := p.pb.FindRecordById("site_releases", releaseId); err == nil {
+			if deployed, err = loadReleaseManifest(p.system, previous); err != nil {
+				return err
+			}
+		}
+	}
+
+	d, err := newDeployer(p.ctx, target)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+
+	for filePath, entry := range p.manifest {
+		if !filepath.IsLocal(filePath) {
+			return fmt.Errorf("invalid file path %q", filePath)
+		}
+		if deployed[filePath].Hash == entry.Hash {
+			p.skipped()
+			continue
+		}
+
+		reader, err := p.system.GetReader(releaseFileKey(p.site, entry.Hash))
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := d.upload(filePath, data); err != nil {
+			return err
+		}
+		p.copied()
+	}
+
+	for filePath := range deployed {
+		if _, ok := p.manifest[filePath]; ok || !filepath.IsLocal(filePath) {
+			continue
+		}
+
+		if err := d.remove(filePath); err != nil {
+			return err
+		}
+		p.deleted()
+	}
+
+	return d.finish(release)
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type directoryDeployConfig struct {
+	// Directory relative to PALA_DEPLOY_ROOT
+	Path string `json:"path"`
+}
+
+// directoryDeployer writes the files into a directory of the server, e.g. the root of a web server. Editors
+// choose the directory, so it is confined to the root set by the operator, and directory targets are
+// disabled unless a root is set.
+type directoryDeployer struct {
+	root string
+}
+
+func newDirectoryDeployer(ctx context.Context, target *core.Record) (deployer, error) {
+	config := directoryDeployConfig{}
+	if err := target.UnmarshalJSONField("config", &config); err != nil {
+		return nil, err
+	}
+	if config.Path == "" {
+		return nil, errors.New("path missing")
+	}
+
+	root := os.Getenv("PALA_DEPLOY_ROOT")
+	if root == "" {
+		return nil, errors.New("directory targets are disabled, PALA_DEPLOY_ROOT is not set")
+	}
+	if !filepath.IsLocal(filepath.FromSlash(config.Path)) {
+		return nil, errors.New("path must be relative to PALA_DEPLOY_ROOT")
+	}
+
+	dir := filepath.Join(root, filepath.FromSlash(config.Path))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &directoryDeployer{root: dir}, nil
+}
+
+func (d *directoryDeployer) upload(filePath string, data []byte) error {
+	fullPath := filepath.Join(d.root, filepath.FromSlash(filePath))
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return err
+	}
+
+	// Write next to the file and rename, so that the web server never reads a partial file
+	tempFile, err := os.CreateTemp(filepath.Dir(fullPath), ".palacms-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tempFile.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), fullPath)
+}
+
+func (d *directoryDeployer) remove(filePath string) error {
+	err := os.Remove(filepath.Join(d.root, filepath.FromSlash(filePath)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *directoryDeployer) finish(release *core.Record) error {
+	return nil
+}
+
+func (d *directoryDeployer) close() error {
+	return nil
+}
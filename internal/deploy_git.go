@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type gitDeployConfig struct {
+	// Repository to push to as an https://, ssh:// or file:// URL including credentials, or as user@host:path
+	Url         string `json:"url"`
+	Branch      string `json:"branch"`
+	Path        string `json:"path"`
+	AuthorName  string `json:"author_name"`
+	AuthorEmail string `json:"author_email"`
+}
+
+// Repository in the scp-like syntax of ssh, as in git@github.com:owner/repo.git
+var scpLikeGitUrl = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*@[A-Za-z0-9][A-Za-z0-9.-]*:[^-\s]\S*$`)
+
+// Whether git may be given the repository URL. Other forms could be taken as an option, or select a
+// transport such as ext:: that runs commands on the server.
+func isAllowedGitUrl(rawUrl string) bool {
+	if strings.HasPrefix(rawUrl, "-") {
+		return false
+	}
+	if scpLikeGitUrl.MatchString(rawUrl) {
+		return true
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	case "https", "ssh":
+		return parsed.Hostname() != "" && !strings.HasPrefix(parsed.Hostname(), "-") && !strings.HasPrefix(parsed.User.Username(), "-")
+	case "file":
+		return parsed.Host == "" && parsed.Path != ""
+	default:
+		return false
+	}
+}
+
+// gitDeployer commits the files to a branch of a repository and pushes it, using the git binary
+type gitDeployer struct {
+	ctx    context.Context
+	config gitDeployConfig
+	dir    string
+}
+
+func newGitDeployer(ctx context.Context, target *core.Record) (deployer, error) {
+	config := gitDeployConfig{}
+	if err := target.UnmarshalJSONField("config", &config); err != nil {
+		return nil, err
+	}
+	if config.Url == "" {
+		return nil, errors.New("url missing")
+	}
+	if !isAllowedGitUrl(config.Url) {
+		return nil, errors.New("url must be an https://, ssh:// or file:// URL, or user@host:path")
+	}
+	if config.Branch == "" {
+		config.Branch = "main"
+	}
+	if config.Path != "" && !filepath.IsLocal(config.Path) {
+		return nil, errors.New("path must be relative to the repository")
+	}
+	if config.AuthorName == "" {
+		config.AuthorName = "PalaCMS"
+	}
+	if config.AuthorEmail == "" {
+		config.AuthorEmail = "publish@palacms.com"
+	}
+
+	dir, err := os.MkdirTemp("", "palacms-deploy-")
+	if err != nil {
+		return nil, err
+	}
+	d := &gitDeployer{ctx: ctx, config: config, dir: dir}
+
+	if _, err := d.git("init", "--quiet"); err != nil {
+		d.close()
+		return nil, err
+	}
+
+	// Continue the history of the branch, or start it if the branch does not exist yet
+	if _, err := d.git("fetch", "--quiet", "--depth", "1", "--", config.Url, "refs/heads/"+config.Branch); err == nil {
+		_, err = d.git("checkout", "--quiet", "-B", config.Branch, "FETCH_HEAD")
+		if err != nil {
+			d.close()
+			return nil, err
+		}
+	} else if _, err := d.git("checkout", "--quiet", "--orphan", config.Branch); err != nil {
+		d.close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *gitDeployer) git(args ...string) (string, error) {
+	cmd := exec.CommandContext(d.ctx, "git", args...)
+	cmd.Dir = d.dir
+	// Transports are limited to the allowed URLs, also for redirects and submodules
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=https:ssh:file")
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
+
+func (d *gitDeployer) fullPath(filePath string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(d.config.Path), filepath.FromSlash(filePath))
+}
+
+func (d *gitDeployer) upload(filePath string, data []byte) error {
+	fullPath := d.fullPath(filePath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(fullPath, data, 0o644)
+}
+
+func (d *gitDeployer) remove(filePath string) error {
+	err := os.Remove(d.fullPath(filePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *gitDeployer) finish(release *core.Record) error {
+	if _, err := d.git("add", "--all"); err != nil {
+		return err
+	}
+
+	status, err := d.git("status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if status == "" {
+		// Nothing changed since the last deploy
+		return nil
+	}
+
+	_, err = d.git(
+		"-c", "user.name="+d.config.AuthorName,
+		"-c", "user.email="+d.config.AuthorEmail,
+		"commit", "--quiet", "-m", "Publish release "+release.Id,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.git("push", "--quiet", "--", d.config.Url, "HEAD:refs/heads/"+d.config.Branch)
+	return err
+}
+
+func (d *gitDeployer) close() error {
+	return os.RemoveAll(d.dir)
+}
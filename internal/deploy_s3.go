@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type s3DeployConfig struct {
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Endpoint        string `json:"endpoint"`
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Prefix          string `json:"prefix"`
+	// Required by most S3-compatible services other than AWS
+	ForcePathStyle bool `json:"force_path_style"`
+}
+
+// s3Deployer uploads the files to a bucket of AWS S3 or any S3-compatible service
+type s3Deployer struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Deployer(ctx context.Context, target *core.Record) (deployer, error) {
+	deployConfig := s3DeployConfig{}
+	if err := target.UnmarshalJSONField("config", &deployConfig); err != nil {
+		return nil, err
+	}
+	if deployConfig.Bucket == "" {
+		return nil, errors.New("bucket missing")
+	}
+	if deployConfig.Region == "" {
+		deployConfig.Region = "us-east-1"
+	}
+
+	// Credentials of the server itself must never be used for targets configured by editors
+	if deployConfig.AccessKeyId == "" || deployConfig.SecretAccessKey == "" {
+		return nil, errors.New("access_key_id and secret_access_key missing")
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(
+		ctx,
+		config.WithRegion(deployConfig.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			deployConfig.AccessKeyId,
+			deployConfig.SecretAccessKey,
+			"",
+		)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if deployConfig.Endpoint != "" {
+			o.BaseEndpoint = aws.String(deployConfig.Endpoint)
+		}
+		o.UsePathStyle = deployConfig.ForcePathStyle
+	})
+
+	prefix := strings.Trim(deployConfig.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &s3Deployer{ctx: ctx, client: client, bucket: deployConfig.Bucket, prefix: prefix}, nil
+}
+
+func (d *s3Deployer) upload(filePath string, data []byte) error {
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	_, err := d.client.PutObject(d.ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(d.bucket),
+		Key:         aws.String(d.prefix + filePath),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (d *s3Deployer) remove(filePath string) error {
+	_, err := d.client.DeleteObject(d.ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + filePath),
+	})
+	return err
+}
+
+func (d *s3Deployer) finish(release *core.Record) error {
+	return nil
+}
+
+func (d *s3Deployer) close() error {
+	return nil
+}
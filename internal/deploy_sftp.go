@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/pkg/sftp"
+	"github.com/pocketbase/pocketbase/core"
+	"golang.org/x/crypto/ssh"
+)
+
+type sftpDeployConfig struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	User       string `json:"user"`
+	Password   string `json:"password"`
+	PrivateKey string `json:"private_key"`
+	// Public key of the server in authorized_keys format
+	HostKey string `json:"host_key"`
+	// Skip verifying the server, only meant for testing
+	InsecureIgnoreHostKey bool   `json:"insecure_ignore_host_key"`
+	Path                  string `json:"path"`
+}
+
+// sftpDeployer uploads the files to a directory of a remote server
+type sftpDeployer struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	root   string
+}
+
+func newSftpDeployer(ctx context.Context, target *core.Record) (deployer, error) {
+	config := sftpDeployConfig{}
+	if err := target.UnmarshalJSONField("config", &config); err != nil {
+		return nil, err
+	}
+	if config.Host == "" {
+		return nil, errors.New("host missing")
+	}
+	if config.Port == 0 {
+		config.Port = 22
+	}
+	if config.Path == "" {
+		config.Path = "."
+	}
+
+	clientConfig := &ssh.ClientConfig{User: config.User}
+	if config.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(config.PrivateKey))
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(config.Password))
+	}
+	if config.HostKey != "" {
+		hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.HostKey))
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	} else if config.InsecureIgnoreHostKey {
+		clientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		return nil, errors.New("host_key missing")
+	}
+
+	dialer := net.Dialer{}
+	address := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConn, channels, requests, err := ssh.NewClientConn(netConn, address, clientConfig)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	conn := ssh.NewClient(sshConn, channels, requests)
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &sftpDeployer{conn: conn, client: client, root: config.Path}, nil
+}
+
+func (d *sftpDeployer) upload(filePath string, data []byte) error {
+	fullPath := path.Join(d.root, filePath)
+	if err := d.client.MkdirAll(path.Dir(fullPath)); err != nil {
+		return err
+	}
+
+	file, err := d.client.Create(fullPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (d *sftpDeployer) remove(filePath string) error {
+	err := d.client.Remove(path.Join(d.root, filePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (d *sftpDeployer) finish(release *core.Record) error {
+	return nil
+}
+
+func (d *sftpDeployer) close() error {
+	d.client.Close()
+	return d.conn.Close()
+}
@@ -0,0 +1,429 @@
+package internal
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type feedItem struct {
+	id      string
+	url     string
+	title   string
+	summary string
+	date    time.Time
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Description string `xml:"description,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	Id      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	Id      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary,omitempty"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageUrl string         `json:"home_page_url"`
+	FeedUrl     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	Id            string `json:"id"`
+	Url           string `json:"url"`
+	Title         string `json:"title"`
+	Summary       string `json:"summary,omitempty"`
+	DatePublished string `json:"date_published"`
+}
+
+// Get the values of top-level page entries by page ID and field key
+func loadPageValues(p *publication) (map[string]map[string]any, error) {
+	fields, err := p.pb.FindRecordsByFilter(
+		"page_type_fields",
+		"page_type.site = {:site}",
+		"",
+		0,
+		0,
+		dbx.Params{"site": p.site.Id},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]string{}
+	for _, field := range fields {
+		keys[field.Id] = field.GetString("key")
+	}
+
+	entries, err := p.pb.FindRecordsByFilter(
+		"page_entries",
+		"page.site = {:site} && parent = '' && (locale = 'en' || locale = '')",
+		"index",
+		0,
+		0,
+		dbx.Params{"site": p.site.Id},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]map[string]any{}
+	for _, entry := range entries {
+		key := keys[entry.GetString("field")]
+		if key == "" {
+			continue
+		}
+
+		var value any
+		if err := entry.UnmarshalJSONField("value", &value); err != nil {
+			continue
+		}
+
+		pageId := entry.GetString("page")
+		if values[pageId] == nil {
+			values[pageId] = map[string]any{}
+		}
+		values[pageId][key] = value
+	}
+
+	return values, nil
+}
+
+func feedValue(values map[string]any, key string) string {
+	value, _ := values[key].(string)
+	return value
+}
+
+func generateFeeds(p *publication) error {
+	feeds, err := p.pb.FindRecordsByFilter(
+		"site_feeds",
+		"site = {:site}",
+		"",
+		0,
+		0,
+		dbx.Params{"site": p.site.Id},
+	)
+	if err != nil {
+		return err
+	}
+
+	p.begin("feeds", len(feeds)*3)
+	if len(feeds) == 0 {
+		return nil
+	}
+
+	values, err := loadPageValues(p)
+	if err != nil {
+		return err
+	}
+
+	// Feeds are validated to have their own directories, but pages may have been moved since
+	dirs := map[string]*core.Record{}
+	for _, feed := range feeds {
+		parentId := feed.GetString("parent_page")
+		if _, published := p.paths[parentId]; parentId != "" && !published {
+			continue
+		}
+
+		dir := feedDir(feed, p.paths[parentId])
+		if other, taken := dirs[dir]; taken {
+			return fmt.Errorf("feeds %q and %q are both published to %s/", other.GetString("name"), feed.GetString("name"), dir)
+		}
+		dirs[dir] = feed
+
+		if err := generateFeed(p, feed, dir, values); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Directory the feed is published to given the path of its parent page. Feeds of a parent page
+// are published alongside it, feeds of a page type in their own directory.
+func feedDir(feed *core.Record, parentPath string) string {
+	if feed.GetString("parent_page") != "" {
+		return parentPath
+	}
+	if slug := feed.GetString("slug"); slug != "" {
+		return "/" + slug
+	}
+	return ""
+}
+
+// Feeds take their items from either a parent page or a page type of the site, and
+// no two feeds of a site are published to the same directory
+func validateFeed(event *core.RecordEvent) error {
+	feed := event.Record
+	siteId := feed.GetString("site")
+	errs := validation.Errors{}
+
+	parentId := feed.GetString("parent_page")
+	pageTypeId := feed.GetString("page_type")
+	switch {
+	case parentId == "" && pageTypeId == "":
+		errs["parent_page"] = validation.NewError("validation_missing_feed_source", "Feed needs either a parent page or a page type.")
+	case parentId != "" && pageTypeId != "":
+		errs["page_type"] = validation.NewError("validation_multiple_feed_sources", "Feed cannot have both a parent page and a page type.")
+	case parentId != "":
+		parent, err := event.App.FindRecordById("pages", parentId)
+		if err != nil || parent.GetString("site") != siteId {
+			errs["parent_page"] = validation.NewError("validation_parent_other_site", "Parent page must belong to the same site.")
+		}
+	default:
+		pageType, err := event.App.FindRecordById("page_types", pageTypeId)
+		if err != nil || pageType.GetString("site") != siteId {
+			errs["page_type"] = validation.NewError("validation_page_type_other_site", "Page type must belong to the same site.")
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	pages, err := event.App.FindAllRecords("pages", dbx.HashExp{"site": siteId})
+	if err != nil {
+		return err
+	}
+
+	// Parent pages which are not part of the page tree are left to the validation of pages
+	dirOf := func(feed *core.Record) (string, bool) {
+		parentPath := ""
+		if parentId := feed.GetString("parent_page"); parentId != "" {
+			index := slices.IndexFunc(pages, func(page *core.Record) bool { return page.Id == parentId })
+			if index < 0 {
+				return "", false
+			}
+			path, err := pagePath(pages, pages[index])
+			if err != nil {
+				return "", false
+			}
+			parentPath = path
+		}
+		return feedDir(feed, parentPath), true
+	}
+
+	dir, ok := dirOf(feed)
+	if !ok {
+		return event.Next()
+	}
+
+	others, err := event.App.FindAllRecords(
+		"site_feeds",
+		dbx.HashExp{"site": siteId},
+		dbx.Not(dbx.HashExp{"id": feed.Id}),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, other := range others {
+		if otherDir, ok := dirOf(other); ok && otherDir == dir {
+			field := "slug"
+			if parentId != "" {
+				field = "parent_page"
+			}
+			return validation.Errors{
+				field: validation.NewError("validation_duplicate_feed_dir", "Another feed of the site is already published to this directory."),
+			}
+		}
+	}
+
+	return event.Next()
+}
+
+func generateFeed(p *publication, feed *core.Record, dir string, values map[string]map[string]any) error {
+	titleField := feed.GetString("title_field")
+	if titleField == "" {
+		titleField = "title"
+	}
+	summaryField := feed.GetString("summary_field")
+	if summaryField == "" {
+		summaryField = "description"
+	}
+	limit := feed.GetInt("limit")
+	if limit == 0 {
+		limit = 20
+	}
+
+	items := []feedItem{}
+	for _, page := range p.pages {
+		path, published := p.paths[page.Id]
+		if !published || page.GetString("status") == pageUnlisted {
+			continue
+		}
+
+		var isItem bool
+		if parentId := feed.GetString("parent_page"); parentId != "" {
+			isItem = page.GetString("parent") == parentId
+		} else {
+			isItem = page.GetString("page_type") == feed.GetString("page_type")
+		}
+		if !isItem {
+			continue
+		}
+
+		item := feedItem{
+			id:      "urn:palacms:" + page.Id,
+			url:     siteUrl(p.site) + path + "/",
+			title:   feedValue(values[page.Id], titleField),
+			summary: feedValue(values[page.Id], summaryField),
+			date:    page.GetDateTime("created").Time(),
+		}
+		if item.title == "" {
+			item.title = page.GetString("name")
+		}
+		if dateField := feed.GetString("date_field"); dateField != "" {
+			for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+				if date, err := time.Parse(layout, feedValue(values[page.Id], dateField)); err == nil {
+					item.date = date
+					break
+				}
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	// Newest first
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].date.After(items[j].date)
+	})
+	if len(items) > limit {
+		items = items[:limit]
+	}
+
+	title := feed.GetString("name")
+	link := siteUrl(p.site) + dir + "/"
+	updated := feed.GetDateTime("updated").Time()
+	if len(items) > 0 {
+		updated = items[0].date
+	}
+
+	rss := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         title,
+			Link:          link,
+			Description:   title,
+			LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+			Items:         []rssItem{},
+		},
+	}
+
+	atom := atomFeed{
+		Title: title,
+		Id:    "urn:palacms:" + feed.Id,
+		Links: []atomLink{
+			{Href: siteUrl(p.site) + dir + "/atom.xml", Rel: "self"},
+			{Href: link},
+		},
+		Updated: updated.UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: p.site.GetString("name")},
+		Entries: []atomEntry{},
+	}
+
+	feedJson := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       title,
+		HomePageUrl: link,
+		FeedUrl:     siteUrl(p.site) + dir + "/feed.json",
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, item := range items {
+		rss.Channel.Items = append(rss.Channel.Items, rssItem{
+			Title:       item.title,
+			Link:        item.url,
+			Guid:        item.url,
+			PubDate:     item.date.UTC().Format(time.RFC1123Z),
+			Description: item.summary,
+		})
+		atom.Entries = append(atom.Entries, atomEntry{
+			Title:   item.title,
+			Id:      item.id,
+			Link:    atomLink{Href: item.url},
+			Updated: item.date.UTC().Format(time.RFC3339),
+			Summary: item.summary,
+		})
+		feedJson.Items = append(feedJson.Items, jsonFeedItem{
+			Id:            item.id,
+			Url:           item.url,
+			Title:         item.title,
+			Summary:       item.summary,
+			DatePublished: item.date.UTC().Format(time.RFC3339),
+		})
+	}
+
+	rssData, err := xml.MarshalIndent(rss, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := p.write(strings.TrimPrefix(dir+"/rss.xml", "/"), append([]byte(xml.Header), rssData...)); err != nil {
+		return err
+	}
+
+	atomData, err := xml.MarshalIndent(atom, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := p.write(strings.TrimPrefix(dir+"/atom.xml", "/"), append([]byte(xml.Header), atomData...)); err != nil {
+		return err
+	}
+
+	jsonData, err := json.MarshalIndent(feedJson, "", "\t")
+	if err != nil {
+		return err
+	}
+	return p.write(strings.TrimPrefix(dir+"/feed.json", "/"), jsonData)
+}
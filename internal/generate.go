@@ -1,164 +1,389 @@
 package internal
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
-	"github.com/pocketbase/pocketbase/tools/filesystem"
 )
 
-func generateSymbols(pb *pocketbase.PocketBase, system *filesystem.System, site *core.Record) ([]string, error) {
-	collection, err := pb.FindCollectionByNameOrId("site_symbols")
+// Publish states of pages, pages without one are published
+const (
+	pageDraft     = "draft"
+	pagePublished = "published"
+	// Published but left out of the sitemap and feeds
+	pageUnlisted = "unlisted"
+)
+
+func generateSymbols(p *publication) error {
+	collection, err := p.pb.FindCollectionByNameOrId("site_symbols")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	symbols, err := pb.FindRecordsByFilter(
+	symbols, err := p.pb.FindRecordsByFilter(
 		collection.Id,
 		"site = {:site}",
 		"",
 		0,
 		0,
-		dbx.Params{"site": site.Id},
+		dbx.Params{"site": p.site.Id},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	newFiles := make([]string, 0, len(symbols))
+	p.begin("symbols", len(symbols))
+	workers := p.workers()
 	for _, symbol := range symbols {
 		name := symbol.GetString("compiled_js")
 		if name == "" {
+			if p.plan != nil {
+				p.plan.SymbolsWithoutJs = append(p.plan.SymbolsWithoutJs, plannedSymbol{
+					Id:   symbol.Id,
+					Name: symbol.GetString("name"),
+				})
+			}
 			continue
 		}
 
 		sourceKey := collection.Id + "/" + symbol.Id + "/" + name
-		destinationKey := "sites/" + site.GetString("host") + "/_symbols/" + symbol.Id + ".js"
-		if err := system.Copy(sourceKey, destinationKey); err != nil {
-			return nil, err
-		}
+		workers.run(func() error {
+			filePath, err := p.copyHashed(sourceKey, "_symbols/"+symbol.Id+".", ".js")
+			if err != nil {
+				return err
+			}
 
-		newFiles = append(newFiles, destinationKey)
+			// Pages import symbols by ID, which is rewritten to the hashed path
+			p.mutex.Lock()
+			p.assets["/_symbols/"+symbol.Id+".js"] = "/" + filePath
+			p.mutex.Unlock()
+			return nil
+		})
 	}
 
-	return newFiles, nil
+	return workers.wait()
 }
 
-func generateUploads(pb *pocketbase.PocketBase, system *filesystem.System, site *core.Record) ([]string, error) {
-	collection, err := pb.FindCollectionByNameOrId("site_uploads")
+func generateUploads(p *publication) error {
+	collection, err := p.pb.FindCollectionByNameOrId("site_uploads")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	uploads, err := pb.FindRecordsByFilter(
+	uploads, err := p.pb.FindRecordsByFilter(
 		collection.Id,
 		"site = {:site}",
 		"",
 		0,
 		0,
-		dbx.Params{"site": site.Id},
+		dbx.Params{"site": p.site.Id},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	newFiles := make([]string, 0, len(uploads))
+	p.begin("uploads", len(uploads))
+	workers := p.workers()
 	for _, upload := range uploads {
 		name := upload.GetString("file")
 		sourceKey := collection.Id + "/" + upload.Id + "/" + name
-		destinationKey := "sites/" + site.GetString("host") + "/_uploads/" + name
-		if err := system.Copy(sourceKey, destinationKey); err != nil {
-			return nil, err
-		}
-
-		newFiles = append(newFiles, destinationKey)
+		workers.run(func() error {
+			if err := p.copy(sourceKey, "_uploads/"+name); err != nil {
+				return err
+			}
+			if !isResizableImage(name) {
+				return nil
+			}
+			return generateImageVariants(p, sourceKey, "_uploads/"+name)
+		})
 	}
 
-	return newFiles, nil
+	return workers.wait()
 }
 
-func generatePages(pb *pocketbase.PocketBase, system *filesystem.System, site *core.Record) ([]string, error) {
-	collection, err := pb.FindCollectionByNameOrId("pages")
+func generatePages(p *publication) error {
+	collection, err := p.pb.FindCollectionByNameOrId("pages")
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	pages, err := pb.FindRecordsByFilter(
+	pages, err := p.pb.FindRecordsByFilter(
 		collection.Id,
 		"site = {:site}",
 		"",
 		0,
 		0,
-		dbx.Params{"site": site.Id},
+		dbx.Params{"site": p.site.Id},
 	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// Pages are rewritten to use the published assets
+	p.versionAssets()
+
+	scopePath := ""
+	if p.scope != nil {
+		if pages, scopePath, err = scopePages(p, pages); err != nil {
+			return err
+		}
 	}
 
-	newFiles := make([]string, 0, len(pages))
+	p.pages = pages
+	p.begin("pages", len(pages))
+	workers := p.workers()
 	for _, page := range pages {
-		if page.GetString("parent") == "" {
-			newPageFiles, err := generatePage(
-				system,
+		isRoot := page.GetString("parent") == ""
+		if p.scope != nil {
+			isRoot = page.Id == p.scope.page.Id
+		}
+
+		if isRoot {
+			err := generatePage(
+				p,
+				workers,
 				collection,
-				site,
 				pages,
 				page,
-				"",
+				scopePath,
 			)
 			if err != nil {
-				return nil, err
+				// Let the started copies finish before failing
+				workers.wait()
+				return err
 			}
+		}
+	}
+
+	return workers.wait()
+}
 
-			newFiles = append(newFiles, newPageFiles...)
+// Site fields designating error pages and the files they are published as
+var errorPages = []struct {
+	field    string
+	filePath string
+}{
+	{"not_found_page", "404.html"},
+	{"maintenance_page", "maintenance.html"},
+}
+
+func isErrorPage(site *core.Record, page *core.Record) bool {
+	for _, errorPage := range errorPages {
+		if site.GetString(errorPage.field) == page.Id {
+			return true
 		}
 	}
+	return false
+}
 
-	return newFiles, nil
+// Publish the error pages of the site, whatever the publish state of the pages
+func generateErrorPages(p *publication) error {
+	collection, err := p.pb.FindCollectionByNameOrId("pages")
+	if err != nil {
+		return err
+	}
+
+	p.begin("errors", len(errorPages))
+	for _, errorPage := range errorPages {
+		var page *core.Record
+		if pageId := p.site.GetString(errorPage.field); pageId != "" {
+			page, _ = p.pb.FindRecordById(collection, pageId)
+		}
+		if page == nil || page.GetString("site") != p.site.Id {
+			// Partial publishes keep the files of the live release
+			p.mutex.Lock()
+			delete(p.manifest, errorPage.filePath)
+			p.mutex.Unlock()
+			continue
+		}
+
+		name := page.GetString("compiled_html")
+		if name == "" && p.plan != nil {
+			continue
+		} else if name == "" {
+			return fmt.Errorf("page %q has not been compiled", page.GetString("name"))
+		}
+
+		if err := p.copyRewritten(collection.Id+"/"+page.Id+"/"+name, errorPage.filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Limit the pages to the scope of the publication and keep the files of the live release outside of it.
+// Returns the pages in scope and the path of the scoped page.
+func scopePages(p *publication, pages []*core.Record) ([]*core.Record, string, error) {
+	byId := map[string]*core.Record{}
+	for _, page := range pages {
+		byId[page.Id] = page
+	}
+
+	root, ok := byId[p.scope.page.Id]
+	if !ok {
+		return nil, "", fmt.Errorf("page %q does not belong to the site", p.scope.page.GetString("name"))
+	}
+
+	rootPath, err := pagePath(pages, root)
+	if err != nil {
+		return nil, "", err
+	}
+
+	scoped := []*core.Record{root}
+	if p.scope.includeChildren {
+		inScope := map[string]bool{root.Id: true}
+		for index := 0; index < len(scoped); index++ {
+			for _, page := range pages {
+				if page.GetString("parent") == scoped[index].Id && !inScope[page.Id] {
+					inScope[page.Id] = true
+					scoped = append(scoped, page)
+				}
+			}
+		}
+	}
+
+	// Published pages in scope are dropped, so that children deleted since are deleted too
+	rootFile := strings.TrimPrefix(rootPath+"/index.html", "/")
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for filePath, entry := range p.previous {
+		inScope := filePath == rootFile ||
+			p.scope.includeChildren && strings.HasSuffix(filePath, "/index.html") && strings.HasPrefix("/"+filePath, rootPath+"/")
+		if _, published := p.manifest[filePath]; !inScope && !published {
+			p.manifest[filePath] = entry
+		}
+	}
+
+	return scoped, rootPath, nil
+}
+
+// Whether the time is within the publish dates of the page, which are both optional
+func isPageLive(page *core.Record, now time.Time) bool {
+	publishAt := page.GetDateTime("publish_at")
+	if !publishAt.IsZero() && now.Before(publishAt.Time()) {
+		return false
+	}
+
+	unpublishAt := page.GetDateTime("unpublish_at")
+	return unpublishAt.IsZero() || now.Before(unpublishAt.Time())
+}
+
+// Path of a page in the site following its parents, which is empty for the home page
+func pagePath(pages []*core.Record, page *core.Record) (string, error) {
+	byId := map[string]*core.Record{}
+	for _, page := range pages {
+		byId[page.Id] = page
+	}
+
+	pagePath := ""
+	visited := map[string]bool{}
+	for current := page; current.GetString("parent") != ""; {
+		if visited[current.Id] {
+			return "", fmt.Errorf("page %q is below itself", current.GetString("name"))
+		}
+		visited[current.Id] = true
+
+		pagePath = "/" + current.GetString("slug") + pagePath
+		parent, ok := byId[current.GetString("parent")]
+		if !ok {
+			return "", fmt.Errorf("parent of page %q does not exist", current.GetString("name"))
+		}
+		current = parent
+	}
+
+	return pagePath, nil
 }
 
 func generatePage(
-	system *filesystem.System,
+	p *publication,
+	workers *workerPool,
 	collection *core.Collection,
-	site *core.Record,
 	pages []*core.Record,
 	page *core.Record,
 	path string,
-) ([]string, error) {
+) error {
+	if page.GetString("status") == pageDraft {
+		// Children of drafts are left out too, since they cannot be reached
+		if p.plan != nil {
+			p.plan.Drafts = append(p.plan.Drafts, newPlannedPage(p.site, page, path))
+		}
+		return nil
+	}
+
+	if !isPageLive(page, p.started) {
+		if p.plan != nil {
+			p.plan.Scheduled = append(p.plan.Scheduled, newPlannedPage(p.site, page, path))
+		}
+		return nil
+	}
+
+	if p.plan != nil {
+		p.plan.Pages = append(p.plan.Pages, newPlannedPage(p.site, page, path))
+	}
+
 	name := page.GetString("compiled_html")
-	sourceKey := collection.Id + "/" + page.Id + "/" + name
-	destinationKey := "sites/" + site.GetString("host") + path + "/index.html"
-	if err := system.Copy(sourceKey, destinationKey); err != nil {
-		return nil, err
+	if name == "" && p.plan != nil {
+		p.plan.PagesWithoutHtml = append(p.plan.PagesWithoutHtml, newPlannedPage(p.site, page, path))
+	} else if name == "" {
+		return fmt.Errorf("page %q has not been compiled", page.GetString("name"))
+	} else {
+		sourceKey := collection.Id + "/" + page.Id + "/" + name
+		workers.run(func() error {
+			return p.copyRewritten(sourceKey, strings.TrimPrefix(path+"/index.html", "/"))
+		})
 	}
+	p.paths[page.Id] = path
+	addToSitemap(p, page, path)
 
-	newFiles := []string{destinationKey}
 	for _, subPage := range pages {
+		if _, generated := p.paths[subPage.Id]; generated {
+			// Guard against cycles in page trees saved before they were validated
+			continue
+		}
 		if subPage.GetString("parent") == page.Id {
-			newSubPageFiles, err := generatePage(
-				system,
+			err := generatePage(
+				p,
+				workers,
 				collection,
-				site,
 				pages,
 				subPage,
 				path+"/"+subPage.GetString("slug"),
 			)
 			if err != nil {
-				return nil, err
+				return err
 			}
-
-			newFiles = append(newFiles, newSubPageFiles...)
 		}
 	}
 
-	return newFiles, nil
+	return nil
 }
 
 func RegisterGenerateEndpoint(pb *pocketbase.PocketBase) error {
+	// Jobs outlive the request that started them and are only stopped on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	pb.OnTerminate().BindFunc(func(event *core.TerminateEvent) error {
+		cancel()
+		return event.Next()
+	})
+
 	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		if err := resumePublishJobs(ctx, pb); err != nil {
+			return err
+		}
+
 		serveEvent.Router.POST("/api/palacms/generate", func(requestEvent *core.RequestEvent) error {
 			body := struct {
 				SiteId string `json:"site_id"`
+				DryRun bool   `json:"dry_run"`
+				// Publish only this page, and its children if included, instead of the whole site
+				PageId          string `json:"page_id"`
+				IncludeChildren bool   `json:"include_children"`
 			}{}
 			requestEvent.BindBody(&body)
 
@@ -181,62 +406,52 @@ func RegisterGenerateEndpoint(pb *pocketbase.PocketBase) error {
 				return requestEvent.ForbiddenError("", err)
 			}
 
-			system, err := pb.NewFilesystem()
+			scope, err := newPublishScope(pb, site, body.PageId, body.IncludeChildren)
 			if err != nil {
-				return err
+				return requestEvent.BadRequestError(err.Error(), nil)
 			}
 
-			existingFiles, err := system.List("sites/" + site.GetString("host") + "/")
-			if err != nil {
-				return err
+			if body.DryRun {
+				// Planning only reads, so it is fast enough to respond with directly
+				plan, err := planSite(requestEvent.Request.Context(), pb, site, scope)
+				if err != nil {
+					return err
+				}
+
+				return requestEvent.JSON(200, plan)
 			}
 
-			symbolFiles, err := generateSymbols(pb, system, site)
+			job, err := enqueuePublishJob(ctx, pb, site, scope)
 			if err != nil {
 				return err
 			}
 
-			uploadFiles, err := generateUploads(pb, system, site)
+			return requestEvent.JSON(202, struct {
+				JobId string `json:"job_id"`
+			}{
+				JobId: job.Id,
+			})
+		})
+
+		serveEvent.Router.GET("/api/palacms/generate/{id}", func(requestEvent *core.RequestEvent) error {
+			job, err := pb.FindRecordById("publish_jobs", requestEvent.Request.PathValue("id"))
 			if err != nil {
-				return err
+				return requestEvent.NotFoundError("", err)
 			}
 
-			pageFiles, err := generatePages(pb, system, site)
+			info, err := requestEvent.RequestInfo()
 			if err != nil {
 				return err
 			}
 
-		cleanup:
-			for _, file := range existingFiles {
-				if file.IsDir {
-					continue
-				}
-
-				for _, symbolFile := range symbolFiles {
-					if file.Key == symbolFile {
-						continue cleanup
-					}
-				}
-
-				for _, uploadFile := range uploadFiles {
-					if file.Key == uploadFile {
-						continue cleanup
-					}
-				}
-
-				for _, pageFile := range pageFiles {
-					if file.Key == pageFile {
-						continue cleanup
-					}
-				}
-
-				if err := system.Delete(file.Key); err != nil {
-					return err
-				}
+			canAccess, err := requestEvent.App.CanAccessRecord(job, info, job.Collection().ViewRule)
+			if !canAccess {
+				return requestEvent.NotFoundError("", err)
 			}
 
-			return nil
+			return requestEvent.JSON(200, job)
 		})
+
 		return serveEvent.Next()
 	})
 
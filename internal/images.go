@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/webp"
+	"github.com/pocketbase/pocketbase/core"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Widths of the resized variants of images, only those smaller than the image are created
+var imageWidths = []int{480, 960, 1440, 1920}
+
+// Images larger than this are published as is, since decoding them takes too much memory
+const maxImagePixels = 50_000_000
+
+// imageVariant is a resized or converted copy of an image, published next to it with the suffix
+type imageVariant struct {
+	Suffix string `json:"suffix"`
+	Width  int    `json:"width"`
+	Webp   bool   `json:"webp"`
+	Hash   string `json:"hash"`
+}
+
+// imageDerivatives lists the variants of an image, stored by the hash of the image
+type imageDerivatives struct {
+	Width    int            `json:"width"`
+	Height   int            `json:"height"`
+	Variants []imageVariant `json:"variants"`
+}
+
+// publishedImage is an upload with variants, which pages are rewritten to use
+type publishedImage struct {
+	derivatives *imageDerivatives
+	// URL path of the image itself
+	src string
+	// URL path of the image without extension, to which the suffixes of the variants are appended
+	stem string
+}
+
+func imageDerivativesKey(site *core.Record, hash string) string {
+	return "releases/" + site.Id + "/images/" + hash + ".json"
+}
+
+func isResizableImage(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// Whether the Accept header lists WebP, as browsers supporting it do when requesting images. Wildcards do
+// not count, since browsers without support send them too.
+func acceptsWebp(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(mediaType), "image/webp") {
+			continue
+		}
+
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			quality, _ = strconv.ParseFloat(value, 64)
+		}
+		return quality > 0
+	}
+	return false
+}
+
+func encodeImage(img image.Image, ext string, asWebp bool) ([]byte, error) {
+	var buffer bytes.Buffer
+	var err error
+	if asWebp {
+		err = webp.Encode(&buffer, img, webp.Options{Quality: 80, Method: 4})
+	} else if ext == ".png" {
+		err = imaging.Encode(&buffer, img, imaging.PNG)
+	} else {
+		err = imaging.Encode(&buffer, img, imaging.JPEG, imaging.JPEGQuality(82))
+	}
+	return buffer.Bytes(), err
+}
+
+// Create the variants of an image, which is published at the file path
+func createImageDerivatives(p *publication, sourceKey string, filePath string) (*imageDerivatives, error) {
+	reader, err := p.system.GetReader(sourceKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width*config.Height > maxImagePixels {
+		// Not an image that can be resized, publish it as is
+		return &imageDerivatives{Variants: []imageVariant{}}, nil
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return &imageDerivatives{Variants: []imageVariant{}}, nil
+	}
+
+	bounds := img.Bounds()
+	derivatives := &imageDerivatives{
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		Variants: []imageVariant{},
+	}
+
+	ext := strings.ToLower(path.Ext(filePath))
+	widths := []int{}
+	for _, width := range imageWidths {
+		if width < derivatives.Width {
+			widths = append(widths, width)
+		}
+	}
+
+	// Each width in both formats, except the image itself
+	p.expect(len(widths)*2 + 1)
+	for _, width := range append(widths, derivatives.Width) {
+		resized := img
+		suffix := ""
+		// The image itself is the variant of its full width in its own format
+		formats := []bool{true}
+		if width != derivatives.Width {
+			resized = imaging.Resize(img, width, 0, imaging.Lanczos)
+			suffix = "." + strconv.Itoa(width) + "w"
+			formats = []bool{false, true}
+		}
+
+		for _, asWebp := range formats {
+			variant := imageVariant{Suffix: suffix + ext, Width: width, Webp: asWebp}
+			if asWebp {
+				variant.Suffix = suffix + ".webp"
+			}
+
+			encoded, err := encodeImage(resized, ext, asWebp)
+			if err != nil {
+				return nil, err
+			}
+
+			variantPath := strings.TrimSuffix(filePath, path.Ext(filePath)) + variant.Suffix
+			if err := p.store(variantPath, sourceKey+"#"+variant.Suffix, encoded); err != nil {
+				return nil, err
+			}
+			hash := sha256.Sum256(encoded)
+			variant.Hash = hex.EncodeToString(hash[:])
+			derivatives.Variants = append(derivatives.Variants, variant)
+		}
+	}
+
+	return derivatives, nil
+}
+
+// Load the variants created by an earlier publish of the same image, if they are all still stored
+func loadImageDerivatives(p *publication, hash string) (*imageDerivatives, error) {
+	key := imageDerivativesKey(p.site, hash)
+	exists, err := p.system.Exists(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	reader, err := p.system.GetReader(key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	derivatives := &imageDerivatives{}
+	if err := json.NewDecoder(reader).Decode(derivatives); err != nil {
+		return nil, err
+	}
+
+	for _, variant := range derivatives.Variants {
+		p.mutex.Lock()
+		_, stored := p.stored[variant.Hash]
+		p.mutex.Unlock()
+		if stored {
+			continue
+		}
+
+		exists, err := p.system.Exists(releaseFileKey(p.site, variant.Hash))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, nil
+		}
+	}
+
+	return derivatives, nil
+}
+
+// Publish the variants of an uploaded image. Variants are only created once for each image
+// content, later publishes reuse them. Dry runs only include variants that already exist.
+func generateImageVariants(p *publication, sourceKey string, filePath string) error {
+	p.mutex.Lock()
+	hash := p.manifest[filePath].Hash
+	p.mutex.Unlock()
+
+	derivatives, err := loadImageDerivatives(p, hash)
+	if err != nil {
+		return err
+	}
+
+	if derivatives != nil {
+		stem := strings.TrimSuffix(filePath, path.Ext(filePath))
+		p.mutex.Lock()
+		for _, variant := range derivatives.Variants {
+			p.manifest[stem+variant.Suffix] = manifestEntry{
+				Source:    sourceKey + "#" + variant.Suffix,
+				Hash:      variant.Hash,
+				Encodings: []string{},
+			}
+			p.stored[variant.Hash] = []string{}
+		}
+		p.mutex.Unlock()
+	} else if p.plan == nil {
+		derivatives, err = createImageDerivatives(p, sourceKey, filePath)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(derivatives)
+		if err != nil {
+			return err
+		}
+		if err := p.system.Upload(data, imageDerivativesKey(p.site, hash)); err != nil {
+			return err
+		}
+	} else {
+		return nil
+	}
+
+	if len(derivatives.Variants) == 0 {
+		return nil
+	}
+
+	// Pages only refer to the image and its variants in the format of the upload, clients accepting
+	// WebP are served the WebP variant of the same width in their place
+	stem := strings.TrimSuffix(filePath, path.Ext(filePath))
+	webpPaths := map[int]string{}
+	for _, variant := range derivatives.Variants {
+		if variant.Webp {
+			webpPaths[variant.Width] = stem + variant.Suffix
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	setWebp := func(filePath string, webpPath string) {
+		if entry, ok := p.manifest[filePath]; ok && webpPath != "" {
+			entry.Webp = webpPath
+			p.manifest[filePath] = entry
+		}
+	}
+	setWebp(filePath, webpPaths[derivatives.Width])
+	for _, variant := range derivatives.Variants {
+		if !variant.Webp {
+			setWebp(stem+variant.Suffix, webpPaths[variant.Width])
+		}
+	}
+
+	p.images["/"+filePath] = &publishedImage{
+		derivatives: derivatives,
+		src:         "/" + filePath,
+		stem:        "/" + stem,
+	}
+	return nil
+}
+
+// Candidates of the srcset of the image, its variants in the format of the upload
+func (i *publishedImage) srcset() string {
+	candidates := []string{}
+	for _, variant := range i.derivatives.Variants {
+		if !variant.Webp {
+			candidates = append(candidates, i.stem+variant.Suffix+" "+strconv.Itoa(variant.Width)+"w")
+		}
+	}
+	candidates = append(candidates, i.src+" "+strconv.Itoa(i.derivatives.Width)+"w")
+	return strings.Join(candidates, ", ")
+}
+
+func setAttr(token *html.Token, key string, value string) {
+	for index, attr := range token.Attr {
+		if attr.Key == key {
+			token.Attr[index].Val = value
+			return
+		}
+	}
+	token.Attr = append(token.Attr, html.Attribute{Key: key, Val: value})
+}
+
+func getAttr(token html.Token, key string) (string, bool) {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// Rewrite the images of an HTML file published at the file path to load the variants fitting the
+// viewport. Only attributes are added to the images, since published pages hydrate their sections
+// and other elements would not match the DOM rendered by the symbols. Images that already have a
+// srcset or are in a picture are left as they are.
+func rewriteImages(data []byte, host string, filePath string, images map[string]*publishedImage) []byte {
+	var output bytes.Buffer
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	inPicture := false
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return output.Bytes()
+		}
+
+		raw := tokenizer.Raw()
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken && tokenType != html.EndTagToken {
+			output.Write(raw)
+			continue
+		}
+
+		// Raw is only valid until the tokenizer moves on, which Token does not do
+		raw = append([]byte{}, raw...)
+		token := tokenizer.Token()
+		if token.DataAtom == atom.Picture {
+			inPicture = tokenType == html.StartTagToken
+		}
+		if tokenType == html.EndTagToken || token.DataAtom != atom.Img || inPicture {
+			output.Write(raw)
+			continue
+		}
+
+		src, _ := getAttr(token, "src")
+		_, hasSrcset := getAttr(token, "srcset")
+		urlPath, internal := resolveRef(host, filePath, strings.TrimSpace(src))
+		image := images[urlPath]
+		if !internal || image == nil || hasSrcset {
+			output.Write(raw)
+			continue
+		}
+
+		sizes := "100vw"
+		widthAttr, _ := getAttr(token, "width")
+		if width, err := strconv.Atoi(widthAttr); err == nil && width > 0 {
+			sizes = fmt.Sprintf("(max-width: %dpx) 100vw, %dpx", width, width)
+		}
+
+		setAttr(&token, "srcset", image.srcset())
+		setAttr(&token, "sizes", sizes)
+		output.WriteString(token.String())
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsWebp(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", true},
+		{"IMAGE/WEBP", true},
+		{"image/webp;q=0.5", true},
+		{"image/webp;q=0", false},
+		{"image/*,*/*;q=0.8", false},
+		{"*/*", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := acceptsWebp(test.accept); got != test.want {
+			t.Errorf("acceptsWebp(%q) = %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestPublishImageVariants(t *testing.T) {
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	var data bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 500))
+	for x := range 1000 {
+		img.Set(x, x/2, color.RGBA{B: 255, A: 255})
+	}
+	if err := png.Encode(&data, img); err != nil {
+		t.Fatal(err)
+	}
+	upload := createTestRecord(t, pb, "site_uploads", map[string]any{
+		"site": fixture.site.Id,
+		"file": testFile(t, data.String(), "photo.png"),
+	})
+	name := upload.GetString("file")
+	stem := strings.TrimSuffix(name, ".png")
+
+	html := `<html><body><div class="photo"><img src="/_uploads/` + name + `" width="500" alt=""></div></body></html>`
+	fixture.home.Set("compiled_html", testFile(t, html, "index.html"))
+	if err := pb.Save(fixture.home); err != nil {
+		t.Fatal(err)
+	}
+	publishTestSite(t, pb, fixture.site)
+
+	if err := ServeSites(pb); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, pb)
+
+	// Hydrated sections must keep the elements rendered by the symbols
+	page := serveTestRequest(handler, "GET", "http://example.com/", nil).Body.String()
+	want := `<div class="photo"><img src="/_uploads/` + name + `" width="500" alt="" srcset="/_uploads/` + stem + `.480w.png 480w, /_uploads/` + stem + `.960w.png 960w, /_uploads/` + name + ` 1000w" sizes="(max-width: 500px) 100vw, 500px"></div>`
+	if !strings.Contains(page, want) {
+		t.Errorf("published page = %s, want it to contain %s", page, want)
+	}
+
+	tests := []struct {
+		path        string
+		accept      string
+		contentType string
+	}{
+		{name, "image/avif,image/webp,*/*", "image/webp"},
+		{name, "image/png,*/*", "image/png"},
+		{stem + ".480w.png", "image/webp", "image/webp"},
+		{stem + ".480w.png", "", "image/png"},
+	}
+
+	for _, test := range tests {
+		response := serveTestRequest(handler, "GET", "http://example.com/_uploads/"+test.path, http.Header{"Accept": {test.accept}})
+		if response.Code != 200 {
+			t.Errorf("%s: status = %d, want 200", test.path, response.Code)
+			continue
+		}
+		if got := response.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s accepting %q: Content-Type = %q, want %q", test.path, test.accept, got, test.contentType)
+		}
+		if got := response.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("%s: Vary = %q, want Accept", test.path, got)
+		}
+	}
+}
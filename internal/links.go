@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// pageRefs holds the URLs referenced by a published HTML file
+type pageRefs struct {
+	// Pages the file links to
+	Links []string `json:"links"`
+	// Scripts, styles, images and other files loaded by the file
+	Assets []string `json:"assets"`
+}
+
+type brokenLink struct {
+	// Path of the HTML file in the site
+	File string `json:"file"`
+	Url  string `json:"url"`
+	// Either "link" or "asset"
+	Kind string `json:"kind"`
+}
+
+// Module imports in inline scripts, such as the imports of symbols for hydration
+var scriptImport = regexp.MustCompile(`(?:\bimport\s*\(|\bfrom)\s*["']([^"']+)["']`)
+
+func extractRefs(data []byte) *pageRefs {
+	links := map[string]bool{}
+	assets := map[string]bool{}
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	inScript := false
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			refs := &pageRefs{Links: []string{}, Assets: []string{}}
+			for link := range links {
+				refs.Links = append(refs.Links, link)
+			}
+			for asset := range assets {
+				refs.Assets = append(refs.Assets, asset)
+			}
+			sort.Strings(refs.Links)
+			sort.Strings(refs.Assets)
+			return refs
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			inScript = token.DataAtom == atom.Script && tokenType == html.StartTagToken
+			for _, attr := range token.Attr {
+				value := strings.TrimSpace(attr.Val)
+				if value == "" {
+					continue
+				}
+
+				switch attr.Key {
+				case "href":
+					if token.DataAtom == atom.A || token.DataAtom == atom.Area {
+						links[value] = true
+					} else if token.DataAtom == atom.Link {
+						assets[value] = true
+					}
+				case "src", "poster":
+					assets[value] = true
+				case "srcset":
+					for _, candidate := range strings.Split(value, ",") {
+						if fields := strings.Fields(candidate); len(fields) > 0 {
+							assets[fields[0]] = true
+						}
+					}
+				}
+			}
+
+		case html.TextToken:
+			if inScript {
+				for _, match := range scriptImport.FindAllSubmatch(tokenizer.Text(), -1) {
+					assets[string(match[1])] = true
+				}
+			}
+
+		case html.EndTagToken:
+			inScript = false
+		}
+	}
+}
+
+// Resolve a URL referenced by a file in the site to the path it is served from,
+// or return false for URLs outside of the site
+func resolveRef(host string, filePath string, ref string) (string, bool) {
+	refUrl, err := url.Parse(ref)
+	if err != nil {
+		return "", false
+	}
+	if refUrl.Scheme != "" && refUrl.Scheme != "http" && refUrl.Scheme != "https" {
+		// E.g. mailto, tel and data URLs
+		return "", false
+	}
+	if refUrl.Host != "" && refUrl.Host != host {
+		return "", false
+	}
+	if refUrl.Scheme == "" && refUrl.Host == "" && refUrl.Path == "" {
+		// Fragment or query of the file itself
+		return "", false
+	}
+
+	base := &url.URL{Scheme: "https", Host: host, Path: strings.TrimSuffix(path.Dir("/"+filePath), "/") + "/"}
+	return base.ResolveReference(refUrl).Path, true
+}
+
+// Whether a path is served from the manifest, following the rules of ServeSites
+func isPublished(manifest publishManifest, urlPath string) bool {
+	filePath := strings.TrimPrefix(urlPath, "/")
+	if filePath == "" {
+		filePath = "index.html"
+	}
+	if _, ok := manifest[filePath]; ok {
+		return true
+	}
+	if path.Ext(filePath) == "" {
+		_, ok := manifest[strings.TrimSuffix(filePath, "/")+"/index.html"]
+		return ok
+	}
+	return false
+}
+
+// Check the links and assets of the published HTML files, failing the publish if the site is set to
+func checkLinks(p *publication) error {
+	// Files published before references were stored, gathered before the workers write to the manifest
+	files := []string{}
+	missingRefs := publishManifest{}
+	for filePath, entry := range p.manifest {
+		if strings.HasSuffix(filePath, ".html") {
+			files = append(files, filePath)
+			if entry.Refs == nil {
+				missingRefs[filePath] = entry
+			}
+		}
+	}
+	sort.Strings(files)
+
+	p.begin("links", len(files))
+	workers := p.workers()
+	for filePath, entry := range missingRefs {
+		workers.run(func() error {
+			reader, err := p.system.GetReader(releaseFileKey(p.site, entry.Hash))
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+
+			p.mutex.Lock()
+			entry.Refs = extractRefs(data)
+			p.manifest[filePath] = entry
+			p.mutex.Unlock()
+			return nil
+		})
+	}
+	if err := workers.wait(); err != nil {
+		return err
+	}
+
+	broken := []brokenLink{}
+	host := p.site.GetString("host")
+	for _, filePath := range files {
+		refs := p.manifest[filePath].Refs
+		for _, kind := range []string{"link", "asset"} {
+			urls := refs.Links
+			if kind == "asset" {
+				urls = refs.Assets
+			}
+
+			for _, ref := range urls {
+				urlPath, internal := resolveRef(host, filePath, ref)
+				if internal && !isPublished(p.manifest, urlPath) && !isRedirected(p.redirects, urlPath) {
+					broken = append(broken, brokenLink{File: filePath, Url: ref, Kind: kind})
+				}
+			}
+		}
+	}
+
+	if p.plan != nil {
+		p.plan.BrokenLinks = broken
+		return nil
+	}
+	if p.job != nil {
+		p.job.Set("broken_links", broken)
+	}
+	if len(broken) == 0 {
+		return nil
+	}
+
+	if p.site.GetString("link_check") == "fail" {
+		return fmt.Errorf("%d broken links, such as %q in %s", len(broken), broken[0].Url, broken[0].File)
+	}
+	p.pb.Logger().Warn("Published site has broken links", "site", p.site.Id, "count", len(broken))
+	return nil
+}
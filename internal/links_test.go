@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveRef(t *testing.T) {
+	tests := []struct {
+		name     string
+		filePath string
+		ref      string
+		want     string
+		internal bool
+	}{
+		{"absolute path", "about/index.html", "/team", "/team", true},
+		{"relative path", "about/index.html", "team/", "/about/team/", true},
+		{"parent path", "about/team/index.html", "../contact", "/about/contact", true},
+		{"from the home page", "index.html", "about", "/about", true},
+		{"query and fragment", "index.html", "/about?tab=1#team", "/about", true},
+		{"same host", "index.html", "https://example.com/about", "/about", true},
+		{"protocol relative", "index.html", "//example.com/about", "/about", true},
+		{"other host", "index.html", "https://other.example/about", "", false},
+		{"fragment only", "about/index.html", "#team", "", false},
+		{"query only", "about/index.html", "?page=2", "", false},
+		{"mailto", "index.html", "mailto:team@example.com", "", false},
+		{"data", "index.html", "data:image/png;base64,AAAA", "", false},
+		{"invalid", "index.html", "http://[::1", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, internal := resolveRef("example.com", test.filePath, test.ref)
+			if got != test.want || internal != test.internal {
+				t.Errorf("resolveRef(%q, %q) = %q, %v, want %q, %v", test.filePath, test.ref, got, internal, test.want, test.internal)
+			}
+		})
+	}
+}
+
+func TestIsPublished(t *testing.T) {
+	manifest := publishManifest{
+		"index.html":                   {},
+		"about/index.html":             {},
+		"_uploads/photo.jpg":           {},
+		"_symbols/abc.0123456789ab.js": {},
+	}
+
+	tests := []struct {
+		urlPath string
+		want    bool
+	}{
+		{"/", true},
+		{"", true},
+		{"/about", true},
+		{"/about/", true},
+		{"/about/index.html", true},
+		{"/about/team", false},
+		{"/_uploads/photo.jpg", true},
+		{"/_uploads/photo.png", false},
+		{"/_symbols/abc.0123456789ab.js", true},
+		{"/_uploads", false},
+	}
+
+	for _, test := range tests {
+		if got := isPublished(manifest, test.urlPath); got != test.want {
+			t.Errorf("isPublished(%q) = %v, want %v", test.urlPath, got, test.want)
+		}
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	html := `<html><body><a href="/">Home</a><a href="/missing">Missing</a><img src="/_uploads/missing.png"></body></html>`
+	fixture.about.Set("compiled_html", testFile(t, html, "index.html"))
+	if err := pb.Save(fixture.about); err != nil {
+		t.Fatal(err)
+	}
+
+	job := publishTestSite(t, pb, fixture.site)
+
+	broken := []brokenLink{}
+	if err := job.UnmarshalJSONField("broken_links", &broken); err != nil {
+		t.Fatal(err)
+	}
+	want := []brokenLink{
+		{File: "about/index.html", Url: "/missing", Kind: "link"},
+		{File: "about/index.html", Url: "/_uploads/missing.png", Kind: "asset"},
+	}
+	if !slices.Equal(broken, want) {
+		t.Errorf("broken links = %v, want %v", broken, want)
+	}
+
+	fixture.site.Set("link_check", "fail")
+	if err := pb.Save(fixture.site); err != nil {
+		t.Fatal(err)
+	}
+
+	job = createTestRecord(t, pb, "publish_jobs", map[string]any{"site": fixture.site.Id, "status": publishJobQueued})
+	runPublishJob(context.Background(), pb, job)
+	if job.GetString("status") != publishJobFailed {
+		t.Errorf("status with link_check=fail = %q, want %q", job.GetString("status"), publishJobFailed)
+	}
+	if !strings.Contains(job.GetString("error"), "2 broken links") {
+		t.Errorf("error = %q, want it to report 2 broken links", job.GetString("error"))
+	}
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Top-level paths used by published files and the CMS itself, which pages cannot take
+var reservedSlugs = func() map[string]bool {
+	slugs := map[string]bool{
+		sitemapPath:        true,
+		robotsPath:         true,
+		redirectsPath:      true,
+		nginxRedirectsPath: true,
+		searchIndexPath:    true,
+		"_symbols":         true,
+		"_uploads":         true,
+		"admin":            true,
+		"api":              true,
+	}
+	for _, errorPage := range errorPages {
+		slugs[errorPage.filePath] = true
+	}
+	return slugs
+}()
+
+// Keep the page tree of a site publishable: pages form a tree within the site and
+// no two pages are published to the same path
+func validatePageTree(event *core.RecordEvent) error {
+	page := event.Record
+	errs := validation.Errors{}
+
+	slug := page.GetString("slug")
+	if strings.ContainsAny(slug, `/\`) || slug == "." || slug == ".." {
+		errs["slug"] = validation.NewError("validation_invalid_slug", "Slug cannot contain slashes or be a relative path.")
+	}
+
+	var parent *core.Record
+	if parentId := page.GetString("parent"); parentId != "" {
+		var err error
+		parent, err = event.App.FindRecordById("pages", parentId)
+		if err != nil {
+			errs["parent"] = validation.NewError("validation_missing_parent", "Parent page does not exist.")
+		} else if parent.GetString("site") != page.GetString("site") {
+			errs["parent"] = validation.NewError("validation_parent_other_site", "Parent page must belong to the same site.")
+		} else if isPageAncestor(event.App, page, parent) {
+			errs["parent"] = validation.NewError("validation_parent_cycle", "Page cannot be moved below itself.")
+		}
+	}
+
+	if _, invalid := errs["parent"]; !invalid {
+		siblings, err := event.App.FindAllRecords(
+			"pages",
+			dbx.HashExp{"site": page.GetString("site"), "parent": page.GetString("parent")},
+			dbx.Not(dbx.HashExp{"id": page.Id}),
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, sibling := range siblings {
+			if parent == nil {
+				// Home pages are published at the root regardless of their slug
+				errs["parent"] = validation.NewError("validation_duplicate_home", "Site already has a home page.")
+				break
+			}
+			if sibling.GetString("slug") == slug {
+				errs["slug"] = validation.NewError("validation_duplicate_slug", "Another page at the same level already uses this slug.")
+				break
+			}
+		}
+	}
+
+	// Children of the home page are published at the top level of the site
+	if parent != nil && parent.GetString("parent") == "" && reservedSlugs[slug] {
+		errs["slug"] = validation.NewError("validation_reserved_slug", "Slug is reserved.")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return event.Next()
+}
+
+// Whether the page is the given page or one of its ancestors
+func isPageAncestor(app core.App, page *core.Record, of *core.Record) bool {
+	visited := map[string]bool{}
+	for current := of; current != nil; {
+		if current.Id == page.Id {
+			return true
+		}
+		if visited[current.Id] {
+			// Already broken tree, which does not contain the page
+			return false
+		}
+		visited[current.Id] = true
+
+		parentId := current.GetString("parent")
+		if parentId == "" {
+			return false
+		}
+		parent, err := app.FindRecordById("pages", parentId)
+		if err != nil {
+			return false
+		}
+		current = parent
+	}
+
+	return false
+}
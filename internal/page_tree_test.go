@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReservedSlugs(t *testing.T) {
+	pb := newTestApp(t)
+	pb.OnRecordValidate("pages").BindFunc(validatePageTree)
+	fixture := createTestSite(t, pb)
+
+	// Publish every kind of file written at the top of the site
+	createTestRecord(t, pb, "redirects", map[string]any{"site": fixture.site.Id, "source": "/old", "target": "/about", "status": "301"})
+	createTestRecord(t, pb, "site_uploads", map[string]any{"site": fixture.site.Id, "file": testFile(t, "text", "notes.txt")})
+	createTestRecord(t, pb, "site_symbols", map[string]any{"name": "Symbol", "site": fixture.site.Id, "compiled_js": testFile(t, "export default 1", "symbol.js")})
+	for _, errorPage := range errorPages {
+		page := createTestRecord(t, pb, "pages", map[string]any{
+			"name":          errorPage.field,
+			"slug":          strings.ReplaceAll(errorPage.field, "_", "-"),
+			"site":          fixture.site.Id,
+			"page_type":     fixture.about.GetString("page_type"),
+			"parent":        fixture.home.Id,
+			"compiled_html": testFile(t, "<html><body>Error</body></html>", "index.html"),
+		})
+		fixture.site.Set(errorPage.field, page.Id)
+	}
+	if err := pb.Save(fixture.site); err != nil {
+		t.Fatal(err)
+	}
+	publishTestSite(t, pb, fixture.site)
+
+	_, manifest := loadTestManifest(t, pb, fixture.site.Id)
+	for filePath := range manifest {
+		top, _, _ := strings.Cut(filePath, "/")
+		if top == "index.html" || top == "about" || strings.HasSuffix(top, "-page") {
+			continue
+		}
+		if !reservedSlugs[top] {
+			t.Errorf("%s is published but %q is not reserved", filePath, top)
+		}
+	}
+
+	for slug := range reservedSlugs {
+		page := createTestRecord(t, pb, "pages", map[string]any{
+			"name":      "Page",
+			"slug":      "page",
+			"site":      fixture.site.Id,
+			"page_type": fixture.about.GetString("page_type"),
+			"parent":    fixture.home.Id,
+		})
+		page.Set("slug", slug)
+		if err := pb.Save(page); err == nil {
+			t.Errorf("page with the reserved slug %q was saved", slug)
+		}
+		if err := pb.Delete(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type plannedPage struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type plannedSymbol struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// publishPlan describes what publishing a site would change compared to its live release
+type publishPlan struct {
+	Add       []string `json:"add"`
+	Overwrite []string `json:"overwrite"`
+	Delete    []string `json:"delete"`
+	Unchanged int      `json:"unchanged"`
+
+	Pages            []plannedPage   `json:"pages"`
+	PagesWithoutHtml []plannedPage   `json:"pages_without_html"`
+	Drafts           []plannedPage   `json:"drafts"`
+	Scheduled        []plannedPage   `json:"scheduled"`
+	SymbolsWithoutJs []plannedSymbol `json:"symbols_without_js"`
+	BrokenLinks      []brokenLink    `json:"broken_links"`
+}
+
+func newPlannedPage(site *core.Record, page *core.Record, path string) plannedPage {
+	return plannedPage{
+		Id:   page.Id,
+		Name: page.GetString("name"),
+		Url:  "https://" + site.GetString("host") + path + "/",
+	}
+}
+
+// Walk the site, or the scope of it if given, like a publish would, without writing anything
+func planSite(ctx context.Context, pb *pocketbase.PocketBase, site *core.Record, scope *publishScope) (*publishPlan, error) {
+	system, err := pb.NewFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	defer system.Close()
+	system.SetContext(ctx)
+
+	p, err := newPublication(ctx, pb, system, site, nil, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	p.plan = &publishPlan{
+		Add:              []string{},
+		Overwrite:        []string{},
+		Delete:           []string{},
+		Pages:            []plannedPage{},
+		PagesWithoutHtml: []plannedPage{},
+		Drafts:           []plannedPage{},
+		Scheduled:        []plannedPage{},
+		SymbolsWithoutJs: []plannedSymbol{},
+	}
+	if err := generateSite(p); err != nil {
+		return nil, err
+	}
+
+	for filePath, entry := range p.manifest {
+		previous, published := p.previous[filePath]
+		if !published {
+			p.plan.Add = append(p.plan.Add, filePath)
+		} else if previous.Hash != entry.Hash {
+			p.plan.Overwrite = append(p.plan.Overwrite, filePath)
+		} else {
+			p.plan.Unchanged++
+		}
+	}
+
+	for filePath := range p.previous {
+		if _, ok := p.manifest[filePath]; !ok {
+			p.plan.Delete = append(p.plan.Delete, filePath)
+		}
+	}
+
+	sort.Strings(p.plan.Add)
+	sort.Strings(p.plan.Overwrite)
+	sort.Strings(p.plan.Delete)
+	return p.plan, nil
+}
@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/security"
+)
+
+// Preview links are valid for a week unless requested otherwise, and for a month at most
+const (
+	defaultPreviewDuration = 7 * 24 * time.Hour
+	maxPreviewDuration     = 30 * 24 * time.Hour
+)
+
+// Secret signing the preview links of the site, which is generated on first use
+func previewSecret(app core.App, site *core.Record) (string, error) {
+	if secret := site.GetString("preview_secret"); secret != "" {
+		return secret, nil
+	}
+
+	site.Set("preview_secret", security.RandomString(50))
+	if err := app.Save(site); err != nil {
+		return "", err
+	}
+	return site.GetString("preview_secret"), nil
+}
+
+func newPreviewToken(app core.App, site *core.Record, page *core.Record, duration time.Duration) (string, error) {
+	secret, err := previewSecret(app, site)
+	if err != nil {
+		return "", err
+	}
+
+	return security.NewJWT(jwt.MapClaims{"type": "preview", "page": page.Id}, secret, duration)
+}
+
+// Get the page a preview token of the site was signed for, failing for expired and revoked tokens
+func parsePreviewToken(app core.App, site *core.Record, token string) (*core.Record, error) {
+	secret := site.GetString("preview_secret")
+	if secret == "" {
+		return nil, errors.New("site has no preview links")
+	}
+
+	claims, err := security.ParseJWT(token, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	pageId, _ := claims["page"].(string)
+	if claims["type"] != "preview" || pageId == "" {
+		return nil, errors.New("not a preview token")
+	}
+
+	page, err := app.FindRecordById("pages", pageId)
+	if err != nil {
+		return nil, err
+	}
+	if page.GetString("site") != site.Id {
+		return nil, errors.New("page does not belong to the site")
+	}
+
+	return page, nil
+}
+
+func findSitePages(app core.App, siteId string) ([]*core.Record, error) {
+	return app.FindAllRecords("pages", dbx.HashExp{"site": siteId})
+}
+
+// Serve the compiled page a preview token was signed for, whatever its publish state. The page
+// loads the assets of the live release, since its own are only published along with it.
+func servePreview(requestEvent *core.RequestEvent, pb *pocketbase.PocketBase, fs *filesystem.System, site *core.Record, reqPath string, token string) error {
+	page, err := parsePreviewToken(pb, site, token)
+	if err != nil {
+		return requestEvent.ForbiddenError("Preview link is invalid or has expired.", nil)
+	}
+
+	pages, err := findSitePages(pb, site.Id)
+	if err != nil {
+		return err
+	}
+	urlPath, err := pagePath(pages, page)
+	if err != nil {
+		return err
+	}
+	if strings.Trim(reqPath, "/") != strings.TrimPrefix(urlPath, "/") {
+		return requestEvent.NotFoundError("", nil)
+	}
+
+	name := page.GetString("compiled_html")
+	if name == "" {
+		return requestEvent.NotFoundError("Page has not been compiled yet.", nil)
+	}
+
+	reader, err := fs.GetReader(page.BaseFilesPath() + "/" + name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if site.GetString("release") != "" {
+		manifest, err := getLiveManifest(pb, fs, site)
+		if err != nil {
+			return err
+		}
+
+		replacements := []string{}
+		for filePath := range manifest {
+			if hashedAsset.MatchString(filePath) {
+				symbolId, _, _ := strings.Cut(path.Base(filePath), ".")
+				replacements = append(replacements, "/_symbols/"+symbolId+".js", "/"+filePath)
+			}
+		}
+		data = []byte(strings.NewReplacer(replacements...).Replace(string(data)))
+	}
+
+	header := requestEvent.Response.Header()
+	header.Set("Cache-Control", "private, no-store")
+	header.Set("X-Robots-Tag", "noindex")
+	return requestEvent.HTML(200, string(data))
+}
+
+func RegisterPreviewEndpoint(pb *pocketbase.PocketBase) error {
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		serveEvent.Router.POST("/api/palacms/preview", func(requestEvent *core.RequestEvent) error {
+			body := struct {
+				PageId string `json:"page_id"`
+				// Seconds until the link expires
+				ExpiresIn int `json:"expires_in"`
+			}{}
+			if err := requestEvent.BindBody(&body); err != nil {
+				return err
+			}
+			if body.PageId == "" {
+				return requestEvent.BadRequestError("page_id missing", nil)
+			}
+
+			duration := defaultPreviewDuration
+			if body.ExpiresIn != 0 {
+				duration = time.Duration(body.ExpiresIn) * time.Second
+			}
+			if duration <= 0 || duration > maxPreviewDuration {
+				return requestEvent.BadRequestError("expires_in must be between 1 second and 30 days", nil)
+			}
+
+			page, err := pb.FindRecordById("pages", body.PageId)
+			if err != nil {
+				return requestEvent.NotFoundError("", err)
+			}
+
+			info, err := requestEvent.RequestInfo()
+			if err != nil {
+				return err
+			}
+
+			canAccess, err := requestEvent.App.CanAccessRecord(page, info, page.Collection().UpdateRule)
+			if !canAccess {
+				return requestEvent.ForbiddenError("", err)
+			}
+
+			site, err := pb.FindRecordById("sites", page.GetString("site"))
+			if err != nil {
+				return err
+			}
+
+			pages, err := findSitePages(pb, site.Id)
+			if err != nil {
+				return err
+			}
+			urlPath, err := pagePath(pages, page)
+			if err != nil {
+				return requestEvent.BadRequestError(err.Error(), nil)
+			}
+
+			token, err := newPreviewToken(pb, site, page, duration)
+			if err != nil {
+				return err
+			}
+
+			return requestEvent.JSON(200, struct {
+				Url     string    `json:"url"`
+				Expires time.Time `json:"expires"`
+			}{
+				Url:     siteUrl(site) + urlPath + "/?preview=" + token,
+				Expires: time.Now().Add(duration).UTC(),
+			})
+		})
+
+		return serveEvent.Next()
+	})
+
+	return nil
+}
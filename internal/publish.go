@@ -0,0 +1,719 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	publishJobQueued    = "queued"
+	publishJobRunning   = "running"
+	publishJobSucceeded = "succeeded"
+	publishJobFailed    = "failed"
+)
+
+// Number of hex digits of the content hash included in the names of hashed assets
+const assetHashLength = 12
+
+// Number of times a job interrupted by a restart is resumed before it is marked failed
+const maxPublishAttempts = 3
+
+// Minimum time between progress updates saved to the job record
+const publishProgressInterval = time.Second
+
+// Only one job publishes a site at a time, keyed by site ID
+var publishLocks sync.Map
+
+// Running jobs are updated at least this often, so that jobs of processes that stopped no longer
+// hold their site once the lease has passed since their last update
+const publishJobLease = time.Minute
+
+// Time between attempts to start a job while another job of the site is running
+const publishJobRetryInterval = 5 * time.Second
+
+type phaseProgress struct {
+	Total   int `json:"total"`
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"`
+	Deleted int `json:"deleted"`
+}
+
+// publishManifest maps the paths of published files to the file they were copied from
+type publishManifest map[string]manifestEntry
+
+type manifestEntry struct {
+	// Empty for files generated during publishing
+	Source string `json:"source"`
+	Hash   string `json:"hash"`
+	// Content encodings of the precompressed variants stored next to the file,
+	// nil for files published before variants were stored
+	Encodings []string `json:"encodings"`
+	// URLs referenced by HTML files, nil for other files and those published before references were stored
+	Refs *pageRefs `json:"refs,omitempty"`
+	// Path of the WebP variant of an image, served instead to clients accepting WebP
+	Webp string `json:"webp,omitempty"`
+}
+
+// publishScope limits a publish to a page and optionally its children, keeping the other files of the live release
+type publishScope struct {
+	page            *core.Record
+	includeChildren bool
+}
+
+// publication holds the state of a single publish of a site
+type publication struct {
+	ctx    context.Context
+	pb     *pocketbase.PocketBase
+	system *filesystem.System
+	site   *core.Record
+	job    *core.Record
+
+	// Files of the live release, files published by this publication and the encodings of the
+	// variants of the stored files by hash
+	previous publishManifest
+	manifest publishManifest
+	stored   map[string][]string
+	// Paths of the files of the live release by source key
+	sources map[string]string
+
+	// Published paths of assets by their unhashed URL path, images with variants by URL path
+	// and a version identifying both
+	assets        map[string]string
+	images        map[string]*publishedImage
+	assetsVersion string
+
+	// Set for dry runs, which only plan the changes without writing anything
+	plan *publishPlan
+	// Set when only publishing some of the pages
+	scope *publishScope
+
+	// Redirect rules of the site
+	redirects []redirectRule
+
+	// Time the publication started, which the publish dates of pages are compared to
+	started time.Time
+
+	// Pages of the site, paths of the published pages by page ID and pages listed in the sitemap
+	pages   []*core.Record
+	paths   map[string]string
+	sitemap []sitemapUrl
+
+	phase    string
+	progress map[string]*phaseProgress
+	saved    time.Time
+
+	// Guards the manifest, stored hashes and progress, which are updated by the workers
+	mutex sync.Mutex
+}
+
+// Start a new phase with the given amount of files to process
+func (p *publication) begin(phase string, total int) {
+	p.phase = phase
+	p.progress[phase] = &phaseProgress{Total: total}
+	p.report(true)
+}
+
+// Add files to process in the current phase, which were not known when it began
+func (p *publication) expect(count int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.progress[p.phase].Total += count
+}
+
+func (p *publication) copied() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.progress[p.phase].Copied++
+	p.report(false)
+}
+
+func (p *publication) skipped() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.progress[p.phase].Skipped++
+	p.report(false)
+}
+
+func (p *publication) deleted() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.progress[p.phase].Deleted++
+	p.report(false)
+}
+
+// Run file operations of the current phase through a worker pool
+func (p *publication) workers() *workerPool {
+	return newWorkerPool(p.ctx, publishConcurrency())
+}
+
+// Copy a source file to the path in the site unless the same content has already been stored
+func (p *publication) copy(sourceKey string, filePath string) error {
+	previous, published := p.previous[filePath]
+	if published && previous.Source == sourceKey && previous.Encodings != nil {
+		// Stored files are never modified, so an unchanged source key means unchanged content
+		p.mutex.Lock()
+		p.manifest[filePath] = previous
+		p.mutex.Unlock()
+		p.skipped()
+		return nil
+	}
+
+	reader, err := p.system.GetReader(sourceKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	return p.store(filePath, sourceKey, data)
+}
+
+// Copy a source file to a path including the hash of its content, as in <prefix><hash><ext>
+func (p *publication) copyHashed(sourceKey string, prefix string, ext string) (string, error) {
+	filePath, published := p.sources[sourceKey]
+	isHashed := len(filePath) == len(prefix)+assetHashLength+len(ext) && strings.HasPrefix(filePath, prefix) && strings.HasSuffix(filePath, ext)
+	if published && isHashed && p.previous[filePath].Encodings != nil {
+		p.mutex.Lock()
+		p.manifest[filePath] = p.previous[filePath]
+		p.mutex.Unlock()
+		p.skipped()
+		return filePath, nil
+	}
+
+	reader, err := p.system.GetReader(sourceKey)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	filePath = prefix + hex.EncodeToString(hash[:])[:assetHashLength] + ext
+	return filePath, p.store(filePath, sourceKey, data)
+}
+
+// Copy a source file to the path in the site, rewriting the asset URLs it references to their hashed paths
+func (p *publication) copyRewritten(sourceKey string, filePath string) error {
+	// Content depends on the assets too, so they are part of the source
+	source := sourceKey
+	if p.assetsVersion != "" {
+		source += "#" + p.assetsVersion
+	}
+
+	previous, published := p.previous[filePath]
+	if published && previous.Source == source && previous.Encodings != nil {
+		p.mutex.Lock()
+		p.manifest[filePath] = previous
+		p.mutex.Unlock()
+		p.skipped()
+		return nil
+	}
+
+	reader, err := p.system.GetReader(sourceKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	if len(p.assets) > 0 {
+		replacements := []string{}
+		for assetPath, hashedPath := range p.assets {
+			replacements = append(replacements, assetPath, hashedPath)
+		}
+		data = []byte(strings.NewReplacer(replacements...).Replace(string(data)))
+	}
+	if len(p.images) > 0 {
+		data = rewriteImages(data, p.site.GetString("host"), filePath, p.images)
+	}
+
+	return p.store(filePath, source, data)
+}
+
+// Identify the current assets, once all of them have been published
+func (p *publication) versionAssets() {
+	if len(p.assets) == 0 && len(p.images) == 0 {
+		p.assetsVersion = ""
+		return
+	}
+
+	versions := map[string]string{}
+	for assetPath, hashedPath := range p.assets {
+		versions[assetPath] = hashedPath
+	}
+	for imagePath, image := range p.images {
+		versions[imagePath] = image.srcset()
+	}
+
+	assetPaths := make([]string, 0, len(versions))
+	for assetPath := range versions {
+		assetPaths = append(assetPaths, assetPath)
+	}
+	sort.Strings(assetPaths)
+
+	hash := sha256.New()
+	for _, assetPath := range assetPaths {
+		hash.Write([]byte(assetPath + "=" + versions[assetPath] + "\n"))
+	}
+	p.assetsVersion = hex.EncodeToString(hash.Sum(nil))[:assetHashLength]
+}
+
+// Write generated content to the path in the site
+func (p *publication) write(filePath string, data []byte) error {
+	return p.store(filePath, "", data)
+}
+
+func (p *publication) store(filePath string, sourceKey string, data []byte) error {
+	hash := sha256.Sum256(data)
+	entry := manifestEntry{
+		Source: sourceKey,
+		Hash:   hex.EncodeToString(hash[:]),
+	}
+	if strings.HasSuffix(filePath, ".html") {
+		entry.Refs = extractRefs(data)
+	}
+	if p.plan != nil {
+		p.mutex.Lock()
+		p.manifest[filePath] = entry
+		p.mutex.Unlock()
+		return nil
+	}
+
+	p.mutex.Lock()
+	encodings, stored := p.stored[entry.Hash]
+	if stored && encodings != nil {
+		entry.Encodings = encodings
+		p.manifest[filePath] = entry
+		p.mutex.Unlock()
+		p.skipped()
+		return nil
+	}
+	p.mutex.Unlock()
+
+	variants, err := compressVariants(data)
+	if err != nil {
+		return err
+	}
+	entry.Encodings = []string{}
+	for _, fileEncoding := range fileEncodings {
+		if _, ok := variants[fileEncoding.name]; ok {
+			entry.Encodings = append(entry.Encodings, fileEncoding.name)
+		}
+	}
+
+	// Files with the same content may be stored concurrently, which only uploads them twice
+	p.mutex.Lock()
+	encodings, stored = p.stored[entry.Hash]
+	p.stored[entry.Hash] = entry.Encodings
+	p.manifest[filePath] = entry
+	p.mutex.Unlock()
+
+	fileKey := releaseFileKey(p.site, entry.Hash)
+	if !stored {
+		if err := p.system.Upload(data, fileKey); err != nil {
+			return err
+		}
+	}
+	if encodings == nil {
+		for encoding, variant := range variants {
+			if err := p.system.Upload(variant, fileKey+encodingSuffix(encoding)); err != nil {
+				return err
+			}
+		}
+	}
+	p.copied()
+	return nil
+}
+
+// Save progress to the job record, which also broadcasts it to realtime subscribers
+func (p *publication) report(force bool) {
+	if p.job == nil {
+		return
+	}
+	if !force && time.Since(p.saved) < publishProgressInterval {
+		return
+	}
+
+	p.job.Set("phase", p.phase)
+	p.job.Set("progress", p.progress)
+	if err := p.pb.Save(p.job); err != nil {
+		p.pb.Logger().Warn("Failed to save publish progress", "job", p.job.Id, "error", err)
+	}
+	p.saved = time.Now()
+}
+
+func newPublication(ctx context.Context, pb *pocketbase.PocketBase, system *filesystem.System, site *core.Record, job *core.Record, scope *publishScope) (*publication, error) {
+	previous, err := loadLiveManifest(pb, system, site)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &publication{
+		ctx:      ctx,
+		pb:       pb,
+		system:   system,
+		site:     site,
+		job:      job,
+		scope:    scope,
+		started:  time.Now(),
+		previous: previous,
+		manifest: publishManifest{},
+		stored:   map[string][]string{},
+		sources:  map[string]string{},
+		assets:   map[string]string{},
+		images:   map[string]*publishedImage{},
+		paths:    map[string]string{},
+		progress: map[string]*phaseProgress{},
+	}
+	for _, entry := range previous {
+		p.stored[entry.Hash] = entry.Encodings
+	}
+	for filePath, entry := range previous {
+		if entry.Source != "" {
+			p.sources[entry.Source] = filePath
+		}
+	}
+
+	return p, nil
+}
+
+func generateSite(p *publication) error {
+	if err := generateSymbols(p); err != nil {
+		return err
+	}
+
+	if err := generateUploads(p); err != nil {
+		return err
+	}
+
+	if err := generatePages(p); err != nil {
+		return err
+	}
+
+	if err := generateErrorPages(p); err != nil {
+		return err
+	}
+
+	if err := generateSearchIndex(p); err != nil {
+		return err
+	}
+
+	// Feeds and the sitemap list every page, so publishing some of them keeps the published ones
+	if p.scope == nil {
+		if err := generateFeeds(p); err != nil {
+			return err
+		}
+
+		if err := generateSitemap(p); err != nil {
+			return err
+		}
+	}
+
+	if err := generateRedirects(p); err != nil {
+		return err
+	}
+
+	if err := checkLinks(p); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func publishSite(ctx context.Context, pb *pocketbase.PocketBase, site *core.Record, job *core.Record, scope *publishScope) error {
+	system, err := pb.NewFilesystem()
+	if err != nil {
+		return err
+	}
+	defer system.Close()
+	system.SetContext(ctx)
+
+	p, err := newPublication(ctx, pb, system, site, job, scope)
+	if err != nil {
+		return err
+	}
+
+	if err := generateSite(p); err != nil {
+		return err
+	}
+
+	release, err := createRelease(pb, site, job, p.manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := deployRelease(p, release); err != nil {
+		return err
+	}
+
+	if err := pruneReleases(p); err != nil {
+		return err
+	}
+
+	p.report(true)
+	return nil
+}
+
+// Limit publishing the site to the page and optionally its children, or publish the whole site if no page is given
+func newPublishScope(pb *pocketbase.PocketBase, site *core.Record, pageId string, includeChildren bool) (*publishScope, error) {
+	if pageId == "" {
+		return nil, nil
+	}
+
+	page, err := pb.FindRecordById("pages", pageId)
+	if err != nil || page.GetString("site") != site.Id {
+		return nil, errors.New("page_id does not belong to the site")
+	}
+	if site.GetString("release") == "" {
+		return nil, errors.New("Site has to be published before publishing single pages.")
+	}
+
+	return &publishScope{page: page, includeChildren: includeChildren}, nil
+}
+
+// Store a new queued publish job for the site, or the scope of it if given
+func createPublishJob(pb *pocketbase.PocketBase, site *core.Record, scope *publishScope) (*core.Record, error) {
+	collection, err := pb.FindCollectionByNameOrId("publish_jobs")
+	if err != nil {
+		return nil, err
+	}
+
+	job := core.NewRecord(collection)
+	job.Set("site", site.Id)
+	job.Set("status", publishJobQueued)
+	if scope != nil {
+		job.Set("page", scope.page.Id)
+		job.Set("include_children", scope.includeChildren)
+	}
+	if err := pb.Save(job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// Store a new publish job for the site, or the scope of it if given, and run it in the background
+func enqueuePublishJob(ctx context.Context, pb *pocketbase.PocketBase, site *core.Record, scope *publishScope) (*core.Record, error) {
+	job, err := createPublishJob(pb, site, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	go runPublishJob(ctx, pb, job)
+	return job, nil
+}
+
+// Mark the job as running unless another job of the site is, whether in this process or another one
+// such as the CLI. The statement is atomic, so that only one process claims the site.
+func claimPublishJob(app core.App, job *core.Record) (bool, error) {
+	now := time.Now()
+	result, err := app.DB().NewQuery(`
+		UPDATE publish_jobs SET status = {:running}, updated = {:now}
+		WHERE id = {:id} AND (status = {:queued} OR status = {:running} AND updated <= {:expired})
+		AND NOT EXISTS (
+			SELECT 1 FROM publish_jobs
+			WHERE site = {:site} AND id != {:id} AND status = {:running} AND updated > {:expired}
+		)
+	`).Bind(dbx.Params{
+		"id":      job.Id,
+		"site":    job.GetString("site"),
+		"queued":  publishJobQueued,
+		"running": publishJobRunning,
+		"now":     types.NowDateTime().String(),
+		"expired": now.Add(-publishJobLease).UTC().Format(types.DefaultDateLayout),
+	}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// Wait until the job is claimed, returning false if it was finished by another process or the context is done
+func waitForPublishJob(ctx context.Context, pb *pocketbase.PocketBase, job *core.Record) bool {
+	for {
+		claimed, err := claimPublishJob(pb, job)
+		if err != nil {
+			pb.Logger().Error("Failed to claim publish job", "job", job.Id, "error", err)
+		} else if claimed {
+			return true
+		}
+
+		stored, err := pb.FindRecordById("publish_jobs", job.Id)
+		if err != nil {
+			return false
+		}
+		if status := stored.GetString("status"); status != publishJobQueued && status != publishJobRunning {
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			// Shutting down, the job is resumed on next start
+			return false
+		case <-time.After(publishJobRetryInterval):
+		}
+	}
+}
+
+// Update the running job within the lease until stopped, also while no progress is saved
+func keepPublishJob(pb *pocketbase.PocketBase, job *core.Record) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(publishJobLease / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := pb.DB().Update(
+					"publish_jobs",
+					dbx.Params{"updated": types.NowDateTime().String()},
+					dbx.HashExp{"id": job.Id},
+				).Execute()
+				if err != nil {
+					pb.Logger().Warn("Failed to keep publish job", "job", job.Id, "error", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func runPublishJob(ctx context.Context, pb *pocketbase.PocketBase, job *core.Record) {
+	lock, _ := publishLocks.LoadOrStore(job.GetString("site"), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	if ctx.Err() != nil {
+		// Shutting down, the job is resumed on next start
+		return
+	}
+
+	// Other processes publishing the site are waited for too, since they share its stored files
+	if !waitForPublishJob(ctx, pb, job) {
+		return
+	}
+	stopKeeping := keepPublishJob(pb, job)
+	defer stopKeeping()
+
+	job.Set("status", publishJobRunning)
+	job.Set("attempts", job.GetInt("attempts")+1)
+	job.Set("started", types.NowDateTime())
+	job.Set("error", "")
+	if err := pb.Save(job); err != nil {
+		pb.Logger().Error("Failed to start publish job", "job", job.Id, "error", err)
+		return
+	}
+	notifyPublishJob(pb, job, "publish.started")
+
+	err := func() error {
+		site, err := pb.FindRecordById("sites", job.GetString("site"))
+		if err != nil {
+			return err
+		}
+
+		scope, err := loadPublishScope(pb, job)
+		if err != nil {
+			return err
+		}
+
+		return publishSite(ctx, pb, site, job, scope)
+	}()
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by shutdown, leave the job running so that it is resumed on next start
+		return
+	}
+
+	job.Set("finished", types.NowDateTime())
+	if err != nil {
+		job.Set("status", publishJobFailed)
+		job.Set("error", err.Error())
+		pb.Logger().Error("Publish job failed", "job", job.Id, "site", job.GetString("site"), "error", err)
+	} else {
+		job.Set("status", publishJobSucceeded)
+	}
+	if err := pb.Save(job); err != nil {
+		pb.Logger().Error("Failed to finish publish job", "job", job.Id, "error", err)
+	}
+	notifyPublishJob(pb, job, "publish."+job.GetString("status"))
+}
+
+func notifyPublishJob(pb *pocketbase.PocketBase, job *core.Record, event string) {
+	if err := emitWebhookEvent(pb, job.GetString("site"), event, job); err != nil {
+		pb.Logger().Warn("Failed to store webhook deliveries", "job", job.Id, "error", err)
+	}
+}
+
+func loadPublishScope(pb *pocketbase.PocketBase, job *core.Record) (*publishScope, error) {
+	pageId := job.GetString("page")
+	if pageId == "" {
+		return nil, nil
+	}
+
+	page, err := pb.FindRecordById("pages", pageId)
+	if err != nil {
+		return nil, fmt.Errorf("page to publish no longer exists: %w", err)
+	}
+
+	return &publishScope{page: page, includeChildren: job.GetBool("include_children")}, nil
+}
+
+// Resume jobs that were queued or running when the server stopped
+func resumePublishJobs(ctx context.Context, pb *pocketbase.PocketBase) error {
+	jobs, err := pb.FindRecordsByFilter(
+		"publish_jobs",
+		"status = {:queued} || status = {:running}",
+		"created",
+		0,
+		0,
+		dbx.Params{"queued": publishJobQueued, "running": publishJobRunning},
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.GetInt("attempts") >= maxPublishAttempts {
+			job.Set("status", publishJobFailed)
+			job.Set("error", "publish interrupted too many times")
+			job.Set("finished", types.NowDateTime())
+			if err := pb.Save(job); err != nil {
+				return err
+			}
+			continue
+		}
+
+		go runPublishJob(ctx, pb, job)
+	}
+
+	return nil
+}
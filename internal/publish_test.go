@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func reloadTestJob(t *testing.T, pb *pocketbase.PocketBase, id string) *core.Record {
+	t.Helper()
+
+	job, err := pb.FindRecordById("publish_jobs", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// Wait until a job run in the background is no longer queued or running
+func waitForTestJob(t *testing.T, pb *pocketbase.PocketBase, id string) *core.Record {
+	t.Helper()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		job := reloadTestJob(t, pb, id)
+		if status := job.GetString("status"); status != publishJobQueued && status != publishJobRunning {
+			return job
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("publish job %s did not finish", id)
+	return nil
+}
+
+func TestRunPublishJob(t *testing.T) {
+	pb := newTestApp(t)
+	site := createTestSite(t, pb).site
+
+	job := publishTestSite(t, pb, site)
+
+	job, err := pb.FindRecordById("publish_jobs", job.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.GetString("status") != publishJobSucceeded {
+		t.Errorf("status = %q, want %q", job.GetString("status"), publishJobSucceeded)
+	}
+	if job.GetInt("attempts") != 1 {
+		t.Errorf("attempts = %d, want 1", job.GetInt("attempts"))
+	}
+	if job.GetDateTime("started").IsZero() || job.GetDateTime("finished").IsZero() {
+		t.Errorf("started = %v, finished = %v, want both set", job.GetDateTime("started"), job.GetDateTime("finished"))
+	}
+}
+
+func TestResumePublishJobs(t *testing.T) {
+	pb := newTestApp(t)
+	site := createTestSite(t, pb).site
+
+	interrupted := createTestRecord(t, pb, "publish_jobs", map[string]any{
+		"site":     site.Id,
+		"status":   publishJobRunning,
+		"attempts": maxPublishAttempts,
+	})
+	queued := createTestRecord(t, pb, "publish_jobs", map[string]any{
+		"site":   site.Id,
+		"status": publishJobQueued,
+	})
+
+	if err := resumePublishJobs(context.Background(), pb); err != nil {
+		t.Fatal(err)
+	}
+
+	interrupted, err := pb.FindRecordById("publish_jobs", interrupted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interrupted.GetString("status") != publishJobFailed {
+		t.Errorf("job interrupted %d times: status = %q, want %q", maxPublishAttempts, interrupted.GetString("status"), publishJobFailed)
+	}
+
+	queued = waitForTestJob(t, pb, queued.Id)
+	if queued.GetString("status") != publishJobSucceeded {
+		t.Errorf("queued job: status = %q, want %q: %s", queued.GetString("status"), publishJobSucceeded, queued.GetString("error"))
+	}
+}
+
+func TestClaimPublishJob(t *testing.T) {
+	pb := newTestApp(t)
+	site := createTestSite(t, pb).site
+
+	// Running in another process, which keeps its lease
+	running := createTestRecord(t, pb, "publish_jobs", map[string]any{
+		"site":     site.Id,
+		"status":   publishJobRunning,
+		"attempts": 1,
+	})
+	queued := createTestRecord(t, pb, "publish_jobs", map[string]any{
+		"site":   site.Id,
+		"status": publishJobQueued,
+	})
+
+	if claimed, err := claimPublishJob(pb, queued); err != nil || claimed {
+		t.Fatalf("claimed a job while another one is running: %v, %v", claimed, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	runPublishJob(ctx, pb, queued)
+	if queued = reloadTestJob(t, pb, queued.Id); queued.GetString("status") != publishJobQueued {
+		t.Errorf("waiting job: status = %q, want %q", queued.GetString("status"), publishJobQueued)
+	}
+
+	// The other process stopped without finishing the job, which is taken over once its lease expires
+	_, err := pb.DB().Update(
+		"publish_jobs",
+		dbx.Params{"updated": time.Now().Add(-2 * publishJobLease).UTC().Format(types.DefaultDateLayout)},
+		dbx.HashExp{"id": running.Id},
+	).Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runPublishJob(context.Background(), pb, running)
+	if running.GetString("status") != publishJobSucceeded || running.GetInt("attempts") != 2 {
+		t.Errorf("expired job: status = %q, attempts = %d, want %q, 2", running.GetString("status"), running.GetInt("attempts"), publishJobSucceeded)
+	}
+
+	runPublishJob(context.Background(), pb, queued)
+	if queued.GetString("status") != publishJobSucceeded {
+		t.Errorf("queued job: status = %q, want %q", queued.GetString("status"), publishJobSucceeded)
+	}
+
+	// Jobs finished by another process are not run again
+	if claimed, err := claimPublishJob(pb, queued); err != nil || claimed {
+		t.Errorf("claimed a finished job: %v, %v", claimed, err)
+	}
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// redirectRule redirects requests for the source path, or those below it for wildcard rules
+type redirectRule struct {
+	source string
+	// Empty for rules answering 410 Gone, ":splat" is replaced by the path below the source
+	target   string
+	status   int
+	wildcard bool
+}
+
+// Redirect rules by site ID, loaded on first request and dropped whenever the rules of the site change
+var siteRedirects sync.Map
+
+// Paths are compared without trailing slash, since pages are served with and without one
+func normalizeRedirectPath(urlPath string) string {
+	return "/" + strings.Trim(urlPath, "/")
+}
+
+// Load the rules of the site, wildcard rules with longer sources first so that the most specific one matches
+func loadRedirects(app core.App, siteId string) ([]redirectRule, error) {
+	records, err := app.FindAllRecords("redirects", dbx.HashExp{"site": siteId})
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []redirectRule{}
+	for _, record := range records {
+		status, err := strconv.Atoi(record.GetString("status"))
+		if err != nil {
+			continue
+		}
+
+		rules = append(rules, redirectRule{
+			source:   normalizeRedirectPath(record.GetString("source")),
+			target:   record.GetString("target"),
+			status:   status,
+			wildcard: record.GetBool("wildcard"),
+		})
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if len(rules[i].source) != len(rules[j].source) {
+			return len(rules[i].source) > len(rules[j].source)
+		}
+		return rules[i].source < rules[j].source
+	})
+	return rules, nil
+}
+
+func getRedirects(pb *pocketbase.PocketBase, site *core.Record) ([]redirectRule, error) {
+	if cached, ok := siteRedirects.Load(site.Id); ok {
+		return cached.([]redirectRule), nil
+	}
+
+	rules, err := loadRedirects(pb, site.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	siteRedirects.Store(site.Id, rules)
+	return rules, nil
+}
+
+// Find the rule matching the path, preferring exact rules over wildcard ones, and the target to redirect to
+func matchRedirect(rules []redirectRule, urlPath string) (redirectRule, string, bool) {
+	urlPath = normalizeRedirectPath(urlPath)
+	for _, rule := range rules {
+		if !rule.wildcard && rule.source == urlPath {
+			return rule, strings.ReplaceAll(rule.target, ":splat", ""), true
+		}
+	}
+
+	for _, rule := range rules {
+		if !rule.wildcard {
+			continue
+		}
+
+		if rule.source == urlPath {
+			return rule, strings.ReplaceAll(rule.target, ":splat", ""), true
+		}
+		if splat, below := strings.CutPrefix(urlPath, strings.TrimSuffix(rule.source, "/")+"/"); below {
+			return rule, strings.ReplaceAll(rule.target, ":splat", splat), true
+		}
+	}
+
+	return redirectRule{}, "", false
+}
+
+// Whether requests for the path end up at another page
+func isRedirected(rules []redirectRule, urlPath string) bool {
+	rule, _, ok := matchRedirect(rules, urlPath)
+	return ok && rule.status != 410
+}
+
+func serveRedirect(requestEvent *core.RequestEvent, rule redirectRule, target string) error {
+	if rule.status == 410 {
+		return requestEvent.Error(410, "The requested page is gone.", nil)
+	}
+
+	if query := requestEvent.Request.URL.RawQuery; query != "" && !strings.Contains(target, "?") {
+		target += "?" + query
+	}
+	return requestEvent.Redirect(rule.status, target)
+}
+
+// Whether the rule matches the path, which is normalized
+func redirectMatches(rule redirectRule, urlPath string) bool {
+	if rule.source == urlPath {
+		return true
+	}
+	return rule.wildcard && strings.HasPrefix(urlPath, strings.TrimSuffix(rule.source, "/")+"/")
+}
+
+// Delete the rules created for pages moved away from the paths, or from the paths above them,
+// since pages are published there now. Rules created by editors are left as they are.
+func clearMovedPageRedirects(app core.App, siteId string, paths []string) error {
+	records, err := app.FindAllRecords("redirects", dbx.HashExp{"site": siteId, "automatic": true})
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		rule := redirectRule{
+			source:   normalizeRedirectPath(record.GetString("source")),
+			wildcard: record.GetBool("wildcard"),
+		}
+		for _, urlPath := range paths {
+			if redirectMatches(rule, normalizeRedirectPath(urlPath)) {
+				if err := app.Delete(record); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// Clear the rules redirecting away from the page and the published pages below it
+func clearPageRedirects(app core.App, page *core.Record) error {
+	if page.GetString("status") == pageDraft {
+		return nil
+	}
+
+	pages, err := findSitePages(app, page.GetString("site"))
+	if err != nil {
+		return err
+	}
+	root, err := pagePath(pages, page)
+	if err != nil {
+		return nil
+	}
+
+	paths := []string{root}
+	for _, other := range pages {
+		if other.Id == page.Id || other.GetString("status") == pageDraft {
+			continue
+		}
+		if otherPath, err := pagePath(pages, other); err == nil && strings.HasPrefix(otherPath, root+"/") {
+			paths = append(paths, otherPath)
+		}
+	}
+
+	return clearMovedPageRedirects(app, page.GetString("site"), paths)
+}
+
+// Redirect the old path of a moved page, and the paths below it, to its new path. Rules created
+// by editors for the old path are left as they are.
+func redirectMovedPage(app core.App, siteId string, oldPath string, newPath string) error {
+	oldPath = normalizeRedirectPath(oldPath)
+	newPath = normalizeRedirectPath(newPath)
+	target := strings.TrimSuffix(newPath, "/") + "/:splat"
+
+	// Pages moved below their old path would be redirected themselves by a wildcard rule
+	wildcard := !strings.HasPrefix(newPath, oldPath+"/")
+	if !wildcard {
+		target = newPath
+	}
+
+	collection, err := app.FindCollectionByNameOrId("redirects")
+	if err != nil {
+		return err
+	}
+
+	records, err := app.FindAllRecords(collection, dbx.HashExp{"site": siteId})
+	if err != nil {
+		return err
+	}
+
+	var existing *core.Record
+	for _, record := range records {
+		if !record.GetBool("automatic") {
+			if record.GetString("source") == oldPath {
+				existing = record
+			}
+			continue
+		}
+
+		switch {
+		case record.GetString("source") == oldPath:
+			existing = record
+		case record.GetString("target") == strings.TrimSuffix(oldPath, "/")+"/:splat":
+			// Redirect earlier paths of the page straight to the new one
+			record.Set("target", strings.TrimSuffix(newPath, "/")+"/:splat")
+			if err := app.Save(record); err != nil {
+				return err
+			}
+		}
+	}
+
+	if existing != nil && !existing.GetBool("automatic") {
+		return nil
+	}
+	if existing == nil {
+		existing = core.NewRecord(collection)
+		existing.Set("site", siteId)
+		existing.Set("source", oldPath)
+		existing.Set("automatic", true)
+	}
+	existing.Set("target", target)
+	existing.Set("status", "301")
+	existing.Set("wildcard", wildcard)
+	return app.Save(existing)
+}
+
+// Create redirects when pages move, drop the ones of paths pages are published at again and
+// drop the cached rules of sites when they change
+func RegisterRedirects(pb *pocketbase.PocketBase) error {
+	pb.OnRecordCreate("pages").BindFunc(func(event *core.RecordEvent) error {
+		if err := event.Next(); err != nil {
+			return err
+		}
+		return clearPageRedirects(event.App, event.Record)
+	})
+
+	pb.OnRecordUpdate("pages").BindFunc(func(event *core.RecordEvent) error {
+		page := event.Record
+		stored, err := event.App.FindRecordById("pages", page.Id)
+		if err != nil {
+			return event.Next()
+		}
+		moved := stored.GetString("slug") != page.GetString("slug") || stored.GetString("parent") != page.GetString("parent")
+		wasDraft := stored.GetString("status") == pageDraft
+		if !moved && (wasDraft == (page.GetString("status") == pageDraft)) {
+			return event.Next()
+		}
+
+		// Paths are resolved through the other pages of the site, which do not change with the page
+		pages, err := findSitePages(event.App, stored.GetString("site"))
+		if err != nil {
+			return err
+		}
+		oldPath, oldErr := pagePath(pages, stored)
+
+		if err := event.Next(); err != nil {
+			return err
+		}
+
+		if err := clearPageRedirects(event.App, page); err != nil {
+			return err
+		}
+
+		pages, err = findSitePages(event.App, page.GetString("site"))
+		if err != nil {
+			return err
+		}
+		newPath, newErr := pagePath(pages, page)
+		if !moved || wasDraft || oldErr != nil || newErr != nil || oldPath == "" || oldPath == newPath {
+			return nil
+		}
+
+		return redirectMovedPage(event.App, page.GetString("site"), oldPath, newPath)
+	})
+
+	invalidate := func(event *core.RecordEvent) error {
+		siteRedirects.Delete(event.Record.GetString("site"))
+		return event.Next()
+	}
+	pb.OnRecordAfterCreateSuccess("redirects").BindFunc(invalidate)
+	pb.OnRecordAfterUpdateSuccess("redirects").BindFunc(invalidate)
+	pb.OnRecordAfterDeleteSuccess("redirects").BindFunc(invalidate)
+
+	return nil
+}
+
+// Quote a string for nginx configuration
+func nginxQuote(value string) string {
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// Paths of the exported rules in the published site
+const (
+	redirectsPath      = "_redirects"
+	nginxRedirectsPath = "_redirects.nginx.conf"
+)
+
+// Export the rules for hosts the site is deployed to, in the _redirects format of Netlify and
+// Cloudflare Pages and as nginx locations to include in the server block of the site
+func generateRedirects(p *publication) error {
+	rules, err := loadRedirects(p.pb, p.site.Id)
+	if err != nil {
+		return err
+	}
+	p.redirects = rules
+
+	p.begin("redirects", 2)
+	if len(rules) == 0 {
+		// Partial publishes keep the files of the live release
+		p.mutex.Lock()
+		delete(p.manifest, redirectsPath)
+		delete(p.manifest, nginxRedirectsPath)
+		p.mutex.Unlock()
+		return nil
+	}
+
+	var netlify strings.Builder
+	var nginx strings.Builder
+	netlify.WriteString("# Redirects of the site, generated when publishing\n")
+	nginx.WriteString("# Redirects of the site, generated when publishing. Include in the server block of the site.\n")
+
+	// nginx uses the first matching location, so exact rules go first
+	for _, wildcard := range []bool{false, true} {
+		for _, rule := range rules {
+			if rule.wildcard != wildcard {
+				continue
+			}
+
+			target := rule.target
+			if rule.status == 410 {
+				target = "/404.html"
+			}
+			fmt.Fprintf(&netlify, "%s %s %d\n", rule.source, strings.ReplaceAll(target, ":splat", ""), rule.status)
+			if rule.wildcard {
+				fmt.Fprintf(&netlify, "%s/* %s %d\n", strings.TrimSuffix(rule.source, "/"), target, rule.status)
+			}
+
+			pattern := "^" + regexp.QuoteMeta(strings.TrimSuffix(rule.source, "/")) + "/?$"
+			nginxTarget := strings.ReplaceAll(target, ":splat", "")
+			if rule.wildcard {
+				pattern = "^" + regexp.QuoteMeta(strings.TrimSuffix(rule.source, "/")) + "(?:/(.*))?$"
+				nginxTarget = strings.ReplaceAll(target, ":splat", "$1")
+			}
+			if !strings.Contains(nginxTarget, "?") {
+				nginxTarget += "$is_args$args"
+			}
+
+			if rule.status == 410 {
+				fmt.Fprintf(&nginx, "location ~ %s { return 410; }\n", nginxQuote(pattern))
+			} else {
+				fmt.Fprintf(&nginx, "location ~ %s { return %d %s; }\n", nginxQuote(pattern), rule.status, nginxQuote(nginxTarget))
+			}
+		}
+	}
+
+	if err := p.write(redirectsPath, []byte(netlify.String())); err != nil {
+		return err
+	}
+	return p.write(nginxRedirectsPath, []byte(nginx.String()))
+}
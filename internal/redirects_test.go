@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/pocketbase/dbx"
+)
+
+func TestMatchRedirect(t *testing.T) {
+	// Sorted like loadRedirects, longer wildcard sources first
+	rules := []redirectRule{
+		{source: "/blog/archive", target: "/archive/:splat", status: 301, wildcard: true},
+		{source: "/blog/2020", target: "/old-posts", status: 302},
+		{source: "/about", target: "/company/:splat", status: 301, wildcard: true},
+		{source: "/about", target: "/about-us", status: 302},
+		{source: "/blog", target: "/news/:splat", status: 301, wildcard: true},
+		{source: "/gone", status: 410},
+		{source: "/shop", target: "https://shop.example/?from=site", status: 302},
+	}
+
+	tests := []struct {
+		urlPath string
+		status  int
+		target  string
+		matches bool
+	}{
+		{"/about", 302, "/about-us", true},
+		{"/about/", 302, "/about-us", true},
+		{"about", 302, "/about-us", true},
+		{"/about/team", 301, "/company/team", true},
+		{"/about/team/lead/", 301, "/company/team/lead", true},
+		{"/aboutus", 0, "", false},
+		{"/blog", 301, "/news/", true},
+		{"/blog/post", 301, "/news/post", true},
+		{"/blog/2020", 302, "/old-posts", true},
+		{"/blog/2020/post", 301, "/news/2020/post", true},
+		{"/blog/archive", 301, "/archive/", true},
+		{"/blog/archive/2019/post", 301, "/archive/2019/post", true},
+		{"/gone", 410, "", true},
+		{"/gone/below", 0, "", false},
+		{"/shop", 302, "https://shop.example/?from=site", true},
+		{"/", 0, "", false},
+		{"/contact", 0, "", false},
+	}
+
+	for _, test := range tests {
+		rule, target, matches := matchRedirect(rules, test.urlPath)
+		if matches != test.matches || rule.status != test.status || target != test.target {
+			t.Errorf("matchRedirect(%q) = %d %q %v, want %d %q %v", test.urlPath, rule.status, target, matches, test.status, test.target, test.matches)
+		}
+	}
+}
+
+func TestRedirectMatches(t *testing.T) {
+	tests := []struct {
+		rule    redirectRule
+		urlPath string
+		want    bool
+	}{
+		{redirectRule{source: "/about"}, "/about", true},
+		{redirectRule{source: "/about"}, "/about/team", false},
+		{redirectRule{source: "/about", wildcard: true}, "/about/team", true},
+		{redirectRule{source: "/about", wildcard: true}, "/aboutus", false},
+		{redirectRule{source: "/about", wildcard: true}, "/", false},
+		{redirectRule{source: "/", wildcard: true}, "/about", true},
+	}
+
+	for _, test := range tests {
+		if got := redirectMatches(test.rule, test.urlPath); got != test.want {
+			t.Errorf("redirectMatches(%+v, %q) = %v, want %v", test.rule, test.urlPath, got, test.want)
+		}
+	}
+}
+
+func TestRedirectMovedPage(t *testing.T) {
+	pb := newTestApp(t)
+	if err := RegisterRedirects(pb); err != nil {
+		t.Fatal(err)
+	}
+	fixture := createTestSite(t, pb)
+
+	automaticRedirects := func() map[string]string {
+		records, err := pb.FindAllRecords("redirects", dbx.HashExp{"site": fixture.site.Id, "automatic": true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		redirects := map[string]string{}
+		for _, record := range records {
+			redirects[record.GetString("source")] = record.GetString("target")
+		}
+		return redirects
+	}
+
+	moves := []struct {
+		slug string
+		want map[string]string
+	}{
+		{"company", map[string]string{"/about": "/company/:splat"}},
+		{"firm", map[string]string{"/about": "/firm/:splat", "/company": "/firm/:splat"}},
+		{"about", map[string]string{"/company": "/about/:splat", "/firm": "/about/:splat"}},
+	}
+
+	for _, move := range moves {
+		fixture.about.Set("slug", move.slug)
+		if err := pb.Save(fixture.about); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := automaticRedirects(); !maps.Equal(got, move.want) {
+			t.Errorf("after moving to /%s: redirects = %v, want %v", move.slug, got, move.want)
+		}
+	}
+}
+
+func TestRedirectClearedByNewPage(t *testing.T) {
+	pb := newTestApp(t)
+	if err := RegisterRedirects(pb); err != nil {
+		t.Fatal(err)
+	}
+	fixture := createTestSite(t, pb)
+
+	fixture.about.Set("slug", "company")
+	if err := pb.Save(fixture.about); err != nil {
+		t.Fatal(err)
+	}
+
+	redirected := func() bool {
+		records, err := pb.FindAllRecords("redirects", dbx.HashExp{"site": fixture.site.Id, "source": "/about"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(records) > 0
+	}
+	if !redirected() {
+		t.Fatal("moved page was not redirected")
+	}
+
+	// Drafts are not published, so the old path stays redirected until the new page is
+	page := createTestRecord(t, pb, "pages", map[string]any{
+		"name":      "About",
+		"slug":      "about",
+		"site":      fixture.site.Id,
+		"page_type": fixture.about.GetString("page_type"),
+		"parent":    fixture.home.Id,
+		"status":    pageDraft,
+	})
+	if !redirected() {
+		t.Error("redirect was removed for a draft page")
+	}
+
+	page.Set("status", pagePublished)
+	if err := pb.Save(page); err != nil {
+		t.Fatal(err)
+	}
+	if redirected() {
+		t.Error("redirect still shadows the published page")
+	}
+}
@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+// Number of most recent releases kept for rollback, in addition to the live release
+func keptReleases() int {
+	count, err := strconv.Atoi(os.Getenv("PALA_KEPT_RELEASES"))
+	if err != nil || count < 1 {
+		return 5
+	}
+	return count
+}
+
+// Published files are stored by content hash, so that releases can share them
+func releaseFilesPrefix(site *core.Record) string {
+	return "releases/" + site.Id + "/files/"
+}
+
+func releaseFileKey(site *core.Record, hash string) string {
+	return releaseFilesPrefix(site) + hash
+}
+
+func loadReleaseManifest(system *filesystem.System, release *core.Record) (publishManifest, error) {
+	reader, err := system.GetReader(release.BaseFilesPath() + "/" + release.GetString("manifest"))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	manifest := publishManifest{}
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Get the manifest of the release currently served for the site, which is empty if the site has not been released
+func loadLiveManifest(pb *pocketbase.PocketBase, system *filesystem.System, site *core.Record) (publishManifest, error) {
+	releaseId := site.GetString("release")
+	if releaseId == "" {
+		return publishManifest{}, nil
+	}
+
+	release, err := pb.FindRecordById("site_releases", releaseId)
+	if err != nil {
+		return nil, err
+	}
+
+	return loadReleaseManifest(system, release)
+}
+
+// Store the manifest as a new release and make it live
+func createRelease(pb *pocketbase.PocketBase, site *core.Record, job *core.Record, manifest publishManifest) (*core.Record, error) {
+	collection, err := pb.FindCollectionByNameOrId("site_releases")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := filesystem.NewFileFromBytes(data, "manifest.json")
+	if err != nil {
+		return nil, err
+	}
+
+	release := core.NewRecord(collection)
+	release.Set("site", site.Id)
+	release.Set("manifest", file)
+	release.Set("files", len(manifest))
+	if job != nil {
+		release.Set("job", job.Id)
+	}
+
+	err = pb.RunInTransaction(func(txApp core.App) error {
+		if err := txApp.Save(release); err != nil {
+			return err
+		}
+
+		// The site may have been edited while publishing, so only the release is changed
+		live, err := txApp.FindRecordById("sites", site.Id)
+		if err != nil {
+			return err
+		}
+
+		live.Set("release", release.Id)
+		return txApp.Save(live)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	site.Set("release", release.Id)
+	return release, nil
+}
+
+// Switch the site to serve an earlier release
+func rollbackRelease(pb *pocketbase.PocketBase, site *core.Record, release *core.Record) error {
+	if release.GetString("site") != site.Id {
+		return errors.New("release does not belong to the site")
+	}
+
+	site.Set("release", release.Id)
+	return pb.Save(site)
+}
+
+// Delete releases beyond the kept ones, except the ones last deployed to targets, and the files no longer used by any release
+func pruneReleases(p *publication) error {
+	releases, err := p.pb.FindRecordsByFilter(
+		"site_releases",
+		"site = {:site}",
+		"-created",
+		0,
+		0,
+		dbx.Params{"site": p.site.Id},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Deploy targets only receive the changes since the release deployed to them
+	targets, err := p.pb.FindAllRecords("deploy_targets", dbx.HashExp{"site": p.site.Id})
+	if err != nil {
+		return err
+	}
+	deployedReleases := map[string]bool{}
+	for _, target := range targets {
+		deployedReleases[target.GetString("release")] = true
+	}
+
+	usedFiles := map[string]bool{}
+	for index, release := range releases {
+		if index >= keptReleases() && release.Id != p.site.GetString("release") && !deployedReleases[release.Id] {
+			if err := p.pb.Delete(release); err != nil {
+				return err
+			}
+			continue
+		}
+
+		manifest, err := loadReleaseManifest(p.system, release)
+		if err != nil {
+			return err
+		}
+		for _, entry := range manifest {
+			usedFiles[releaseFileKey(p.site, entry.Hash)] = true
+			for _, encoding := range entry.Encodings {
+				usedFiles[releaseFileKey(p.site, entry.Hash)+encodingSuffix(encoding)] = true
+			}
+		}
+	}
+
+	storedFiles, err := p.system.List(releaseFilesPrefix(p.site))
+	if err != nil {
+		return err
+	}
+
+	// Files published before releases existed are served from the host prefix
+	legacyFiles, err := p.system.List("sites/" + p.site.GetString("host") + "/")
+	if err != nil {
+		return err
+	}
+
+	legacyManifests, err := p.system.List("manifests/" + p.site.Id + ".json")
+	if err != nil {
+		return err
+	}
+	legacyFiles = append(legacyFiles, legacyManifests...)
+
+	// Variants of images are listed by the hash of the image
+	imageFiles, err := p.system.List("releases/" + p.site.Id + "/images/")
+	if err != nil {
+		return err
+	}
+	for _, file := range imageFiles {
+		hash := strings.TrimSuffix(path.Base(file.Key), ".json")
+		if usedFiles[releaseFileKey(p.site, hash)] {
+			usedFiles[file.Key] = true
+		}
+	}
+
+	p.begin("cleanup", len(storedFiles)+len(imageFiles)+len(legacyFiles))
+	workers := p.workers()
+	for _, file := range slices.Concat(storedFiles, imageFiles, legacyFiles) {
+		if usedFiles[file.Key] || file.IsDir {
+			continue
+		}
+
+		workers.run(func() error {
+			if err := p.system.Delete(file.Key); err != nil {
+				return err
+			}
+			p.deleted()
+			return nil
+		})
+	}
+
+	return workers.wait()
+}
+
+func RegisterReleaseEndpoints(pb *pocketbase.PocketBase) error {
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		serveEvent.Router.GET("/api/palacms/releases", func(requestEvent *core.RequestEvent) error {
+			siteId := requestEvent.Request.URL.Query().Get("site_id")
+			if siteId == "" {
+				return requestEvent.BadRequestError("site_id missing", nil)
+			}
+
+			site, err := pb.FindRecordById("sites", siteId)
+			if err != nil {
+				return err
+			}
+
+			info, err := requestEvent.RequestInfo()
+			if err != nil {
+				return err
+			}
+
+			canAccess, err := requestEvent.App.CanAccessRecord(site, info, site.Collection().ViewRule)
+			if !canAccess {
+				return requestEvent.ForbiddenError("", err)
+			}
+
+			releases, err := pb.FindRecordsByFilter(
+				"site_releases",
+				"site = {:site}",
+				"-created",
+				0,
+				0,
+				dbx.Params{"site": site.Id},
+			)
+			if err != nil {
+				return err
+			}
+
+			return requestEvent.JSON(200, struct {
+				Live     string         `json:"live"`
+				Releases []*core.Record `json:"releases"`
+			}{
+				Live:     site.GetString("release"),
+				Releases: releases,
+			})
+		})
+
+		serveEvent.Router.POST("/api/palacms/rollback", func(requestEvent *core.RequestEvent) error {
+			body := struct {
+				SiteId    string `json:"site_id"`
+				ReleaseId string `json:"release_id"`
+			}{}
+			if err := requestEvent.BindBody(&body); err != nil {
+				return err
+			}
+			if body.SiteId == "" {
+				return requestEvent.BadRequestError("site_id missing", nil)
+			}
+			if body.ReleaseId == "" {
+				return requestEvent.BadRequestError("release_id missing", nil)
+			}
+
+			site, err := pb.FindRecordById("sites", body.SiteId)
+			if err != nil {
+				return err
+			}
+
+			info, err := requestEvent.RequestInfo()
+			if err != nil {
+				return err
+			}
+
+			canAccess, err := requestEvent.App.CanAccessRecord(site, info, site.Collection().UpdateRule)
+			if !canAccess {
+				return requestEvent.ForbiddenError("", err)
+			}
+
+			release, err := pb.FindRecordById("site_releases", body.ReleaseId)
+			if err != nil {
+				return err
+			}
+
+			if err := rollbackRelease(pb, site, release); err != nil {
+				return requestEvent.BadRequestError(err.Error(), nil)
+			}
+
+			return requestEvent.NoContent(204)
+		})
+
+		return serveEvent.Next()
+	})
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+)
+
+// Load the manifest of the release the site serves
+func loadTestManifest(t *testing.T, pb *pocketbase.PocketBase, siteId string) (*core.Record, publishManifest) {
+	t.Helper()
+
+	site, err := pb.FindRecordById("sites", siteId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := pb.FindRecordById("site_releases", site.GetString("release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	system, err := pb.NewFilesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.Close()
+
+	manifest, err := loadReleaseManifest(system, release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release, manifest
+}
+
+func TestPruneReleases(t *testing.T) {
+	t.Setenv("PALA_KEPT_RELEASES", "2")
+
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	releases := []*core.Record{}
+	manifests := []publishManifest{}
+	for _, content := range []string{"First", "Second", "Third", "Fourth"} {
+		fixture.about.Set("compiled_html", testFile(t, "<html><body>"+content+"</body></html>", "index.html"))
+		if err := pb.Save(fixture.about); err != nil {
+			t.Fatal(err)
+		}
+
+		publishTestSite(t, pb, fixture.site)
+		release, manifest := loadTestManifest(t, pb, fixture.site.Id)
+		releases = append(releases, release)
+		manifests = append(manifests, manifest)
+	}
+
+	system, err := pb.NewFilesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.Close()
+
+	fileExists := func(hash string) bool {
+		exists, err := system.Exists(releaseFileKey(fixture.site, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	site, err := pb.FindRecordById("sites", fixture.site.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live := site.GetString("release"); live != releases[len(releases)-1].Id {
+		t.Errorf("live release = %s, want the last one %s", live, releases[len(releases)-1].Id)
+	}
+
+	keptHashes := map[string]bool{}
+	for index, release := range releases {
+		_, err := pb.FindRecordById("site_releases", release.Id)
+		if kept := index >= len(releases)-2; kept != (err == nil) {
+			t.Errorf("release %d: kept = %v, want %v", index+1, err == nil, kept)
+		}
+		if index < len(releases)-2 {
+			continue
+		}
+
+		for path, entry := range manifests[index] {
+			keptHashes[entry.Hash] = true
+			if !fileExists(entry.Hash) {
+				t.Errorf("release %d: file of %s was deleted", index+1, path)
+			}
+		}
+	}
+
+	for index, manifest := range manifests[:len(manifests)-2] {
+		for path, entry := range manifest {
+			if !keptHashes[entry.Hash] && fileExists(entry.Hash) {
+				t.Errorf("pruned release %d: file of %s was kept", index+1, path)
+			}
+		}
+	}
+
+	// The home page is the same in every release, so its file is shared by pruned and kept ones
+	home := manifests[0]["index.html"]
+	if home.Hash == "" || home.Hash != manifests[len(manifests)-1]["index.html"].Hash {
+		t.Errorf("home page is not shared between releases: %v", manifests)
+	}
+}
+
+func TestPruneReleasesKeepsDeployedReleases(t *testing.T) {
+	t.Setenv("PALA_KEPT_RELEASES", "1")
+
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	publishTestSite(t, pb, fixture.site)
+	deployed, manifest := loadTestManifest(t, pb, fixture.site.Id)
+
+	// A disabled target keeps the release it was last deployed with
+	createTestRecord(t, pb, "deploy_targets", map[string]any{
+		"site":    fixture.site.Id,
+		"name":    "Web server",
+		"type":    "directory",
+		"config":  map[string]any{"path": "site"},
+		"release": deployed.Id,
+	})
+
+	for _, content := range []string{"Second", "Third"} {
+		fixture.about.Set("compiled_html", testFile(t, "<html><body>"+content+"</body></html>", "index.html"))
+		if err := pb.Save(fixture.about); err != nil {
+			t.Fatal(err)
+		}
+		publishTestSite(t, pb, fixture.site)
+	}
+
+	if _, err := pb.FindRecordById("site_releases", deployed.Id); err != nil {
+		t.Fatalf("deployed release was pruned: %v", err)
+	}
+
+	system, err := pb.NewFilesystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer system.Close()
+
+	for path, entry := range manifest {
+		if exists, err := system.Exists(releaseFileKey(fixture.site, entry.Hash)); err != nil || !exists {
+			t.Errorf("file of %s in the deployed release was deleted", path)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func publishScheduleJobId(siteId string) string {
+	return "publish_palacms_site_" + siteId
+}
+
+// Publish the whole site unless a publish of it is already waiting or running
+func publishOnSchedule(ctx context.Context, pb *pocketbase.PocketBase, siteId string) {
+	site, err := pb.FindRecordById("sites", siteId)
+	if err != nil {
+		return
+	}
+
+	pending, err := pb.CountRecords("publish_jobs", dbx.HashExp{
+		"site":   site.Id,
+		"page":   "",
+		"status": []any{publishJobQueued, publishJobRunning},
+	})
+	if err != nil || pending > 0 {
+		return
+	}
+
+	if _, err := enqueuePublishJob(ctx, pb, site, nil); err != nil {
+		pb.Logger().Error("Failed to start scheduled publish", "site", site.Id, "error", err)
+	}
+}
+
+// Register the cron job publishing the site on its schedule, or remove it if the site has none
+func schedulePublishes(ctx context.Context, pb *pocketbase.PocketBase, site *core.Record) {
+	jobId := publishScheduleJobId(site.Id)
+	schedule := site.GetString("publish_schedule")
+	if schedule == "" {
+		pb.Cron().Remove(jobId)
+		return
+	}
+
+	siteId := site.Id
+	err := pb.Cron().Add(jobId, schedule, func() { publishOnSchedule(ctx, pb, siteId) })
+	if err != nil {
+		pb.Cron().Remove(jobId)
+		pb.Logger().Warn("Failed to schedule publishes", "site", site.Id, "error", err)
+	}
+}
+
+// Find the published sites with pages whose publish dates have passed since the site was last published
+func findSitesWithPassedPublishDates(app core.App) ([]string, error) {
+	siteIds := []string{}
+	err := app.DB().NewQuery(`
+		SELECT DISTINCT pages.site FROM pages
+		JOIN sites ON sites.id = pages.site
+		JOIN (
+			SELECT sites.id AS site, COALESCE(MAX(publish_jobs.created), '') AS published FROM sites
+			LEFT JOIN publish_jobs ON publish_jobs.site = sites.id AND publish_jobs.page = ''
+			GROUP BY sites.id
+		) latest ON latest.site = pages.site
+		WHERE sites.release != '' AND (
+			pages.publish_at != '' AND pages.publish_at <= {:now} AND pages.publish_at > latest.published OR
+			pages.unpublish_at != '' AND pages.unpublish_at <= {:now} AND pages.unpublish_at > latest.published
+		)
+	`).Bind(dbx.Params{"now": types.NowDateTime().String()}).Column(&siteIds)
+	return siteIds, err
+}
+
+// Pages are to be unpublished after they are published
+func validatePublishDates(event *core.RecordEvent) error {
+	publishAt := event.Record.GetDateTime("publish_at")
+	unpublishAt := event.Record.GetDateTime("unpublish_at")
+	if !publishAt.IsZero() && !unpublishAt.IsZero() && !unpublishAt.After(publishAt) {
+		return validation.Errors{
+			"unpublish_at": validation.NewError("validation_unpublish_before_publish", "Page has to be unpublished after it is published."),
+		}
+	}
+	return event.Next()
+}
+
+// Publish schedules of sites are to be valid cron expressions
+func validatePublishSchedule(event *core.RecordEvent) error {
+	if schedule := event.Record.GetString("publish_schedule"); schedule != "" {
+		if _, err := cron.NewSchedule(schedule); err != nil {
+			return validation.Errors{
+				"publish_schedule": validation.NewError("validation_invalid_cron", "Publish schedule is not a valid cron expression."),
+			}
+		}
+	}
+	return event.Next()
+}
+
+// Publish sites on their schedules and when the publish dates of their pages pass
+func RegisterPublishSchedules(pb *pocketbase.PocketBase) error {
+	pb.OnRecordValidate("pages").BindFunc(validatePublishDates)
+	pb.OnRecordValidate("sites").BindFunc(validatePublishSchedule)
+
+	// Scheduled publishes are only stopped on shutdown like the ones started by editors
+	ctx, cancel := context.WithCancel(context.Background())
+	pb.OnTerminate().BindFunc(func(event *core.TerminateEvent) error {
+		cancel()
+		return event.Next()
+	})
+
+	pb.OnRecordAfterCreateSuccess("sites").BindFunc(func(event *core.RecordEvent) error {
+		schedulePublishes(ctx, pb, event.Record)
+		return event.Next()
+	})
+	pb.OnRecordAfterUpdateSuccess("sites").BindFunc(func(event *core.RecordEvent) error {
+		schedulePublishes(ctx, pb, event.Record)
+		return event.Next()
+	})
+	pb.OnRecordAfterDeleteSuccess("sites").BindFunc(func(event *core.RecordEvent) error {
+		pb.Cron().Remove(publishScheduleJobId(event.Record.Id))
+		return event.Next()
+	})
+
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		sites, err := pb.FindAllRecords("sites", dbx.Not(dbx.HashExp{"publish_schedule": ""}))
+		if err != nil {
+			return err
+		}
+		for _, site := range sites {
+			schedulePublishes(ctx, pb, site)
+		}
+
+		if err := pb.Cron().Add(
+			"publish_palacms_scheduled_pages",
+			"* * * * *",
+			func() {
+				siteIds, err := findSitesWithPassedPublishDates(pb)
+				if err != nil {
+					pb.Logger().Error("Failed to find pages with passed publish dates", "error", err)
+					return
+				}
+				for _, siteId := range siteIds {
+					publishOnSchedule(ctx, pb, siteId)
+				}
+			},
+		); err != nil {
+			return err
+		}
+
+		return serveEvent.Next()
+	})
+
+	return nil
+}
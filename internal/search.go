@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/sync/singleflight"
+)
+
+// Path of the search index in the published site
+const searchIndexPath = "_search.json"
+
+// Characters of text indexed for each page
+const maxSearchText = 20_000
+
+// searchDocument is the searchable content of a published page
+type searchDocument struct {
+	// URL path of the page
+	Url         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Text        string `json:"text"`
+	// Hash of the published file the content was extracted from
+	Hash string `json:"hash"`
+}
+
+// Releases whose search index has been loaded into the database by site ID
+var searchIndexed sync.Map
+
+// Sites being indexed, so that concurrent searches only index them once
+var searchIndexing singleflight.Group
+
+// Extract the title, description and visible text of an HTML page
+func extractSearchDocument(data []byte) searchDocument {
+	document := searchDocument{}
+	var title, heading, text strings.Builder
+
+	tokenizer := nethtml.NewTokenizer(bytes.NewReader(data))
+	// Element whose text is collected separately or skipped
+	var inside atom.Atom
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case nethtml.ErrorToken:
+			document.Title = strings.Join(strings.Fields(title.String()), " ")
+			if document.Title == "" {
+				document.Title = strings.Join(strings.Fields(heading.String()), " ")
+			}
+			document.Text = strings.Join(strings.Fields(text.String()), " ")
+			if len(document.Text) > maxSearchText {
+				cut := maxSearchText
+				for cut > 0 && !utf8.RuneStart(document.Text[cut]) {
+					cut--
+				}
+				document.Text = document.Text[:cut]
+			}
+			return document
+
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Title, atom.H1, atom.Script, atom.Style, atom.Noscript, atom.Template:
+				if tokenType == nethtml.StartTagToken && inside == 0 {
+					inside = token.DataAtom
+				}
+			case atom.Meta:
+				name, _ := getAttr(token, "name")
+				if strings.EqualFold(name, "description") {
+					document.Description, _ = getAttr(token, "content")
+				}
+			}
+
+		case nethtml.EndTagToken:
+			if token := tokenizer.Token(); token.DataAtom == inside {
+				inside = 0
+				text.WriteString(" ")
+			}
+
+		case nethtml.TextToken:
+			content := string(tokenizer.Text())
+			switch inside {
+			case atom.Title:
+				title.WriteString(content)
+			case atom.H1:
+				heading.WriteString(content + " ")
+				text.WriteString(content)
+			case 0:
+				text.WriteString(content)
+			}
+		}
+	}
+}
+
+func readSearchIndex(system *filesystem.System, site *core.Record, manifest publishManifest) ([]searchDocument, error) {
+	entry, ok := manifest[searchIndexPath]
+	if !ok {
+		return []searchDocument{}, nil
+	}
+
+	reader, err := system.GetReader(releaseFileKey(site, entry.Hash))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	documents := []searchDocument{}
+	if err := json.NewDecoder(reader).Decode(&documents); err != nil {
+		return nil, err
+	}
+	return documents, nil
+}
+
+// Publish the search index of the listed pages, reusing the content of unchanged pages
+func generateSearchIndex(p *publication) error {
+	if p.plan != nil {
+		// Page content is only stored when publishing, keep the published index
+		if entry, ok := p.previous[searchIndexPath]; ok {
+			p.manifest[searchIndexPath] = entry
+		}
+		return nil
+	}
+
+	pages, err := findSitePages(p.pb, p.site.Id)
+	if err != nil {
+		return err
+	}
+
+	previous, err := readSearchIndex(p.system, p.site, p.previous)
+	if err != nil {
+		// Index is created from scratch
+		previous = []searchDocument{}
+	}
+	extracted := map[string]searchDocument{}
+	for _, document := range previous {
+		extracted[document.Hash] = document
+	}
+
+	documents := make([]searchDocument, 0, len(pages))
+	for _, page := range pages {
+		if page.GetString("status") == pageDraft || page.GetString("status") == pageUnlisted || isErrorPage(p.site, page) {
+			continue
+		}
+
+		urlPath, err := pagePath(pages, page)
+		if err != nil {
+			continue
+		}
+		entry, published := p.manifest[strings.TrimPrefix(urlPath+"/index.html", "/")]
+		if !published {
+			continue
+		}
+
+		// Named after the page unless it has a title
+		documents = append(documents, searchDocument{Url: urlPath + "/", Title: page.GetString("name"), Hash: entry.Hash})
+	}
+
+	p.begin("search", len(documents)+1)
+	workers := p.workers()
+	for index := range documents {
+		if document, ok := extracted[documents[index].Hash]; ok {
+			document.Url = documents[index].Url
+			documents[index] = document
+			p.skipped()
+			continue
+		}
+
+		workers.run(func() error {
+			reader, err := p.system.GetReader(releaseFileKey(p.site, documents[index].Hash))
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				return err
+			}
+
+			document := extractSearchDocument(data)
+			if document.Title == "" {
+				document.Title = documents[index].Title
+			}
+			document.Url = documents[index].Url
+			document.Hash = documents[index].Hash
+			documents[index] = document
+			p.copied()
+			return nil
+		})
+	}
+	if err := workers.wait(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(documents)
+	if err != nil {
+		return err
+	}
+	return p.write(searchIndexPath, data)
+}
+
+// Load the search index of the live release of the site into the full-text search table, unless it already is
+func ensureSearchIndex(pb *pocketbase.PocketBase, fs *filesystem.System, site *core.Record) error {
+	releaseId := site.GetString("release")
+	if indexed, ok := searchIndexed.Load(site.Id); ok && indexed == releaseId {
+		return nil
+	}
+
+	_, err, _ := searchIndexing.Do(site.Id, func() (any, error) {
+		manifest, err := getLiveManifest(pb, fs, site)
+		if err != nil {
+			return nil, err
+		}
+
+		documents, err := readSearchIndex(fs, site, manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		err = pb.RunInTransaction(func(txApp core.App) error {
+			if _, err := txApp.DB().Delete("_palacms_search", dbx.HashExp{"site": site.Id}).Execute(); err != nil {
+				return err
+			}
+
+			for _, document := range documents {
+				_, err := txApp.DB().Insert("_palacms_search", dbx.Params{
+					"site":        site.Id,
+					"url":         document.Url,
+					"title":       document.Title,
+					"description": document.Description,
+					"text":        document.Text,
+				}).Execute()
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		searchIndexed.Store(site.Id, releaseId)
+		return nil, nil
+	})
+	return err
+}
+
+// Turn a search query into an FTS5 query matching every word as a prefix
+func searchMatchQuery(query string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Snippets are marked with private use characters, which are replaced by tags once the text is escaped
+const (
+	snippetStart = "\ue000"
+	snippetEnd   = "\ue001"
+)
+
+func RegisterSearchEndpoint(pb *pocketbase.PocketBase) error {
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		fs, err := pb.NewFilesystem()
+		if err != nil {
+			return err
+		}
+
+		serveEvent.Router.GET("/api/palacms/search", func(requestEvent *core.RequestEvent) error {
+			query := requestEvent.Request.URL.Query()
+			siteId := query.Get("site")
+			if siteId == "" {
+				return requestEvent.BadRequestError("site missing", nil)
+			}
+
+			limit := 20
+			if value := query.Get("limit"); value != "" {
+				parsed, err := strconv.Atoi(value)
+				if err != nil || parsed < 1 || parsed > 50 {
+					return requestEvent.BadRequestError("limit must be between 1 and 50", nil)
+				}
+				limit = parsed
+			}
+
+			type searchResult struct {
+				Url         string `json:"url"`
+				Title       string `json:"title"`
+				Description string `json:"description"`
+				// HTML with the matching words wrapped in <mark>
+				Snippet string `json:"snippet"`
+			}
+			results := []searchResult{}
+
+			// Search is public like the published sites themselves
+			site, err := pb.FindRecordById("sites", siteId)
+			if err != nil {
+				return requestEvent.NotFoundError("", err)
+			}
+
+			match := searchMatchQuery(query.Get("q"))
+			if match == "" || site.GetString("release") == "" {
+				return requestEvent.JSON(200, struct {
+					Results []searchResult `json:"results"`
+				}{Results: results})
+			}
+
+			if err := ensureSearchIndex(pb, fs, site); err != nil {
+				return err
+			}
+
+			rows := []struct {
+				Url         string `db:"url"`
+				Title       string `db:"title"`
+				Description string `db:"description"`
+				Snippet     string `db:"snippet"`
+			}{}
+			err = pb.DB().NewQuery(
+				"SELECT url, title, description, snippet(_palacms_search, 4, {:start}, {:end}, '…', 16) AS snippet " +
+					"FROM _palacms_search WHERE _palacms_search MATCH {:match} AND site = {:site} " +
+					"ORDER BY bm25(_palacms_search, 0, 0, 10, 5, 1) LIMIT {:limit}",
+			).Bind(dbx.Params{
+				"start": snippetStart,
+				"end":   snippetEnd,
+				"match": match,
+				"site":  site.Id,
+				"limit": limit,
+			}).All(&rows)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range rows {
+				snippet := html.EscapeString(row.Snippet)
+				snippet = strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>").Replace(snippet)
+				results = append(results, searchResult{
+					Url:         siteUrl(site) + row.Url,
+					Title:       row.Title,
+					Description: row.Description,
+					Snippet:     snippet,
+				})
+			}
+
+			return requestEvent.JSON(200, struct {
+				Results []searchResult `json:"results"`
+			}{Results: results})
+		})
+
+		return serveEvent.Next()
+	})
+
+	return nil
+}
@@ -1,16 +1,94 @@
 package internal
 
 import (
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
 )
 
+type liveRelease struct {
+	id       string
+	manifest publishManifest
+}
+
+// Manifests of the served releases by site ID. Releases are immutable, so a manifest
+// only needs to be loaded again when the site switches to another release.
+var liveReleases sync.Map
+
+func getLiveManifest(pb *pocketbase.PocketBase, fs *filesystem.System, site *core.Record) (publishManifest, error) {
+	releaseId := site.GetString("release")
+	if cached, ok := liveReleases.Load(site.Id); ok && cached.(*liveRelease).id == releaseId {
+		return cached.(*liveRelease).manifest, nil
+	}
+
+	manifest, err := loadLiveManifest(pb, fs, site)
+	if err != nil {
+		return nil, err
+	}
+
+	liveReleases.Store(site.Id, &liveRelease{id: releaseId, manifest: manifest})
+	return manifest, nil
+}
+
+// Symbols are published with the hash of their content in the name
+var hashedAsset = regexp.MustCompile(`^_symbols/[^/]+\.[0-9a-f]{` + strconv.Itoa(assetHashLength) + `}\.js$`)
+
+// Hashed assets and uploads, which get a unique name when uploaded, never change and can be
+// cached indefinitely. Everything else is revalidated, so that a publish shows up immediately.
+func cacheControl(filePath string) string {
+	if hashedAsset.MatchString(filePath) || strings.HasPrefix(filePath, "_uploads/") {
+		return "public, max-age=31536000, immutable"
+	}
+	return "public, max-age=0, must-revalidate"
+}
+
+func serveFile(requestEvent *core.RequestEvent, fs *filesystem.System, fileKey string, fileName string) error {
+	reader, err := fs.GetReader(fileKey)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	http.ServeContent(
+		requestEvent.Response,
+		requestEvent.Request,
+		fileName,
+		reader.ModTime(),
+		reader,
+	)
+	return nil
+}
+
+// Serve a published error page with the status, instead of the file that was requested
+func serveErrorPage(requestEvent *core.RequestEvent, fs *filesystem.System, site *core.Record, entry manifestEntry, status int) error {
+	reader, err := fs.GetReader(releaseFileKey(site, entry.Hash))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	requestEvent.Response.Header().Set("Cache-Control", "no-store")
+	return requestEvent.HTML(status, string(data))
+}
+
 func ServeSites(pb *pocketbase.PocketBase) error {
+	deleteImageTransforms(pb)
+
 	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
 		fs, err := pb.NewFilesystem()
 		if err != nil {
@@ -33,24 +111,111 @@ func ServeSites(pb *pocketbase.PocketBase) error {
 			}
 
 			reqHost := requestEvent.Request.Host
+			var site *core.Record
 			if siteId != "" {
-				site, err := pb.FindRecordById("sites", siteId)
+				site, err = pb.FindRecordById("sites", siteId)
 				if err != nil {
 					return err
 				}
 
 				// Override host based on the resolved site ID
 				reqHost = site.GetString("host")
+			} else {
+				// Sites that are not found are served from the host prefix as before
+				site, _ = pb.FindFirstRecordByData("sites", "host", reqHost)
 			}
 
 			reqPath := requestEvent.Request.PathValue("path")
+			isHome := reqPath == ""
+
+			if token := requestEvent.Request.URL.Query().Get("preview"); token != "" && site != nil {
+				return servePreview(requestEvent, pb, fs, site, reqPath, token)
+			}
+
+			if name, ok := strings.CutPrefix(reqPath, "_uploads/"); ok && site != nil && isImageTransform(requestEvent.Request.URL.Query()) {
+				return serveImageTransform(requestEvent, pb, fs, site, name)
+			}
+
+			if site != nil {
+				rules, err := getRedirects(pb, site)
+				if err != nil {
+					return err
+				}
+				if rule, target, ok := matchRedirect(rules, reqPath); ok {
+					return serveRedirect(requestEvent, rule, target)
+				}
+			}
+
+			if site != nil && site.GetString("release") != "" {
+				// Serve from the live release
+				manifest, err := getLiveManifest(pb, fs, site)
+				if err != nil {
+					return err
+				}
+
+				filePath := reqPath
+				if isHome {
+					// Rewrite home page
+					filePath = "index.html"
+				}
+
+				// Pages are replaced during maintenance, the files they load are still served
+				if ext := path.Ext(filePath); site.GetBool("maintenance") && (ext == "" || ext == ".html") {
+					if entry, ok := manifest["maintenance.html"]; ok {
+						requestEvent.Response.Header().Set("Retry-After", "3600")
+						return serveErrorPage(requestEvent, fs, site, entry, 503)
+					}
+				}
+
+				entry, ok := manifest[filePath]
+				if !ok && path.Ext(filePath) == "" {
+					// Fallback to index.html
+					filePath = strings.TrimSuffix(filePath, "/") + "/index.html"
+					entry, ok = manifest[filePath]
+				}
+				if !ok {
+					if notFound, ok := manifest["404.html"]; ok {
+						return serveErrorPage(requestEvent, fs, site, notFound, 404)
+					}
+					return requestEvent.NotFoundError("", nil)
+				}
+
+				if entry.Webp != "" {
+					requestEvent.Response.Header().Add("Vary", "Accept")
+					if webp, ok := manifest[entry.Webp]; ok && acceptsWebp(requestEvent.Request.Header.Get("Accept")) {
+						filePath, entry = entry.Webp, webp
+					}
+				}
+
+				// Released files are identified by their hash, modification times go back on rollback
+				header := requestEvent.Response.Header()
+				header.Set("Cache-Control", cacheControl(filePath))
+				etag := entry.Hash
+
+				fileKey := releaseFileKey(site, entry.Hash)
+				if len(entry.Encodings) > 0 {
+					header.Add("Vary", "Accept-Encoding")
+
+					// Content type cannot be sniffed from compressed content, so it must be known from the extension
+					encoding := negotiateEncoding(requestEvent.Request.Header.Get("Accept-Encoding"), entry.Encodings)
+					contentType := mime.TypeByExtension(path.Ext(filePath))
+					if encoding != "" && contentType != "" {
+						header.Set("Content-Type", contentType)
+						header.Set("Content-Encoding", encoding)
+						fileKey += encodingSuffix(encoding)
+						etag += "-" + encoding
+					}
+				}
+				header.Set("ETag", `"`+etag+`"`)
+
+				return serveFile(requestEvent, fs, fileKey, path.Base(filePath))
+			}
+
 			fileKey := "sites/" + reqHost + "/" + reqPath
 			fileName := path.Base(fileKey)
 
-			isHome := false
-			if reqPath == "" {
+			if isHome {
 				// Rewrite home page
-				isHome = true
 				fileKey = fileKey + "index.html"
 				fileName = "index.html"
 			}
@@ -58,29 +223,18 @@ func ServeSites(pb *pocketbase.PocketBase) error {
 			exists, err := fs.Exists(fileKey)
 			if err != nil {
 				return err
-			} else if !exists && isHome {
-				// Home not found, redirect to site editor
+			} else if !exists && isHome && site == nil {
+				// Home not found on a host without a site, redirect to site editor
 				return requestEvent.Redirect(302, "/admin")
+			} else if !exists && isHome {
+				return requestEvent.NotFoundError("", nil)
 			} else if !exists && path.Ext(fileKey) == "" {
 				// Fallback to index.html
 				fileKey = strings.TrimSuffix(fileKey, "/") + "/index.html"
 				fileName = "index.html"
 			}
 
-			reader, err := fs.GetReader(fileKey)
-			if err != nil {
-				return err
-			}
-			defer reader.Close()
-
-			http.ServeContent(
-				requestEvent.Response,
-				requestEvent.Request,
-				fileName,
-				reader.ModTime(),
-				reader,
-			)
-			return nil
+			return serveFile(requestEvent, fs, fileKey, fileName)
 		})
 
 		return serveEvent.Next()
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"encoding/xml"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+type sitemapUrl struct {
+	Loc      string `xml:"loc"`
+	Lastmod  string `xml:"lastmod,omitempty"`
+	Priority string `xml:"priority,omitempty"`
+}
+
+type sitemapUrlset struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+func siteUrl(site *core.Record) string {
+	return "https://" + site.GetString("host")
+}
+
+// Add a published page to the sitemap unless it has been excluded, is unlisted or is an error page
+func addToSitemap(p *publication, page *core.Record, path string) {
+	if page.GetBool("sitemap_exclude") || page.GetString("status") == pageUnlisted || isErrorPage(p.site, page) {
+		return
+	}
+
+	url := sitemapUrl{
+		Loc: siteUrl(p.site) + path + "/",
+	}
+	if updated := page.GetDateTime("updated"); !updated.IsZero() {
+		url.Lastmod = updated.Time().UTC().Format(time.RFC3339)
+	}
+	if priority := page.GetFloat("sitemap_priority"); priority > 0 {
+		url.Priority = strconv.FormatFloat(priority, 'f', -1, 64)
+	}
+
+	p.sitemap = append(p.sitemap, url)
+}
+
+// Paths of the sitemap and robots.txt in the published site
+const (
+	sitemapPath = "sitemap.xml"
+	robotsPath  = "robots.txt"
+)
+
+func generateSitemap(p *publication) error {
+	p.begin("sitemap", 2)
+
+	data, err := xml.MarshalIndent(sitemapUrlset{Urls: p.sitemap}, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := p.write(sitemapPath, append([]byte(xml.Header), data...)); err != nil {
+		return err
+	}
+
+	// Allow everything by default, sites can replace the whole file
+	robots := p.site.GetString("robots")
+	if robots == "" {
+		robots = "User-agent: *\nAllow: /\n\nSitemap: " + siteUrl(p.site) + "/" + sitemapPath + "\n"
+	}
+
+	return p.write(robotsPath, []byte(robots))
+}
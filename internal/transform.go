@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"golang.org/x/sync/singleflight"
+)
+
+// imageTransform is a resize of an upload requested with the query of its URL
+type imageTransform struct {
+	width  int
+	height int
+	// Either "contain" to fit the image within the size or "cover" to crop it to the size
+	fit string
+	// Extension of the format to convert the image to
+	ext string
+}
+
+// Transforms being created by cache key, so that concurrent requests only create them once
+var imageTransforms singleflight.Group
+
+// Slots of the transforms created at the same time. Anyone can request transforms of different sizes,
+// and each one decodes the whole upload into memory.
+var imageTransformSlots = make(chan struct{}, 2)
+
+// Uploads larger than this are not transformed on request. Anyone can request transforms, so the limit
+// is far below the one of publishing.
+const maxTransformPixels = 16_000_000
+
+func isImageTransform(query url.Values) bool {
+	return query.Has("w") || query.Has("h") || query.Has("fit") || query.Has("fmt")
+}
+
+func parseImageTransform(query url.Values, name string) (*imageTransform, error) {
+	transform := &imageTransform{
+		fit: query.Get("fit"),
+		ext: strings.ToLower(path.Ext(name)),
+	}
+
+	var err error
+	if value := query.Get("w"); value != "" {
+		if transform.width, err = strconv.Atoi(value); err != nil || transform.width < 1 {
+			return nil, fmt.Errorf("invalid width %q", value)
+		}
+	}
+	if value := query.Get("h"); value != "" {
+		if transform.height, err = strconv.Atoi(value); err != nil || transform.height < 1 {
+			return nil, fmt.Errorf("invalid height %q", value)
+		}
+	}
+
+	switch transform.fit {
+	case "":
+		transform.fit = "contain"
+	case "contain":
+	case "cover":
+		if transform.width == 0 || transform.height == 0 {
+			return nil, fmt.Errorf("cover requires both width and height")
+		}
+	default:
+		return nil, fmt.Errorf("invalid fit %q", transform.fit)
+	}
+
+	switch format := query.Get("fmt"); format {
+	case "":
+	case "webp", "png":
+		transform.ext = "." + format
+	case "jpeg", "jpg":
+		transform.ext = ".jpg"
+	default:
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+
+	return transform, nil
+}
+
+// Whether the size is listed in the image sizes of the site, as in "640x360", "640x" or "x360"
+func isAllowedImageSize(site *core.Record, width int, height int) bool {
+	sizes := []string{}
+	if err := site.UnmarshalJSONField("image_sizes", &sizes); err != nil {
+		return false
+	}
+
+	size := ""
+	if width > 0 {
+		size += strconv.Itoa(width)
+	}
+	size += "x"
+	if height > 0 {
+		size += strconv.Itoa(height)
+	}
+
+	for _, allowed := range sizes {
+		if strings.TrimSpace(allowed) == size {
+			return true
+		}
+	}
+	return false
+}
+
+func transformsPrefix(siteId string, name string) string {
+	return "transforms/" + siteId + "/" + name + "/"
+}
+
+func (t *imageTransform) cacheKey(site *core.Record, upload *core.Record) string {
+	key := fmt.Sprintf("%dx%d-%s", t.width, t.height, t.fit)
+	if t.fit == "cover" {
+		// Crops change along with the focal point
+		focalX, focalY := uploadFocalPoint(upload)
+		key += fmt.Sprintf("-%gx%g", focalX, focalY)
+	}
+	return transformsPrefix(site.Id, upload.GetString("file")) + key + t.ext
+}
+
+// Relative position of the part of an upload to keep when cropping, the center by default
+func uploadFocalPoint(upload *core.Record) (float64, float64) {
+	if upload.GetFloat("focal_x") == 0 && upload.GetFloat("focal_y") == 0 {
+		return 0.5, 0.5
+	}
+	return upload.GetFloat("focal_x"), upload.GetFloat("focal_y")
+}
+
+// Resize the image, cropping it around the focal point when covering the size
+func (t *imageTransform) apply(img image.Image, focalX float64, focalY float64) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if t.fit == "cover" {
+		scale := math.Max(float64(t.width)/float64(width), float64(t.height)/float64(height))
+		scaledWidth := max(t.width, int(math.Round(float64(width)*scale)))
+		scaledHeight := max(t.height, int(math.Round(float64(height)*scale)))
+		if scaledWidth != width || scaledHeight != height {
+			img = imaging.Resize(img, scaledWidth, scaledHeight, imaging.Lanczos)
+		}
+
+		left := min(max(int(math.Round(focalX*float64(scaledWidth)))-t.width/2, 0), scaledWidth-t.width)
+		top := min(max(int(math.Round(focalY*float64(scaledHeight)))-t.height/2, 0), scaledHeight-t.height)
+		return imaging.Crop(img, image.Rect(left, top, left+t.width, top+t.height))
+	}
+
+	boxWidth, boxHeight := t.width, t.height
+	if boxWidth == 0 || boxWidth > width {
+		boxWidth = width
+	}
+	if boxHeight == 0 || boxHeight > height {
+		boxHeight = height
+	}
+	return imaging.Fit(img, boxWidth, boxHeight, imaging.Lanczos)
+}
+
+var errImageTooLarge = errors.New("image is too large to transform")
+
+func createImageTransform(system *filesystem.System, upload *core.Record, transform *imageTransform) ([]byte, error) {
+	name := upload.GetString("file")
+	reader, err := system.GetReader(upload.BaseFilesPath() + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > maxTransformPixels {
+		return nil, errImageTooLarge
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, err
+	}
+
+	focalX, focalY := uploadFocalPoint(upload)
+	return encodeImage(transform.apply(img, focalX, focalY), transform.ext, transform.ext == ".webp")
+}
+
+// Serve an upload of the site resized as requested, creating the transformed image on first request
+func serveImageTransform(requestEvent *core.RequestEvent, pb *pocketbase.PocketBase, fs *filesystem.System, site *core.Record, name string) error {
+	if !isResizableImage(name) {
+		return requestEvent.BadRequestError("Only JPEG and PNG images can be transformed.", nil)
+	}
+
+	transform, err := parseImageTransform(requestEvent.Request.URL.Query(), name)
+	if err != nil {
+		return requestEvent.BadRequestError(err.Error(), nil)
+	}
+	if !isAllowedImageSize(site, transform.width, transform.height) {
+		return requestEvent.BadRequestError("Image size is not allowed for the site.", nil)
+	}
+
+	upload, err := pb.FindFirstRecordByFilter(
+		"site_uploads",
+		"site = {:site} && file = {:name}",
+		dbx.Params{"site": site.Id, "name": name},
+	)
+	if err != nil {
+		return requestEvent.NotFoundError("", err)
+	}
+
+	cacheKey := transform.cacheKey(site, upload)
+	_, err, _ = imageTransforms.Do(cacheKey, func() (any, error) {
+		exists, err := fs.Exists(cacheKey)
+		if err != nil || exists {
+			return nil, err
+		}
+
+		select {
+		case imageTransformSlots <- struct{}{}:
+			defer func() { <-imageTransformSlots }()
+		case <-requestEvent.Request.Context().Done():
+			return nil, requestEvent.Request.Context().Err()
+		}
+
+		data, err := createImageTransform(fs, upload, transform)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fs.Upload(data, cacheKey)
+	})
+	if errors.Is(err, errImageTooLarge) {
+		return requestEvent.BadRequestError(err.Error(), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Uploads never change, so neither do their transforms
+	requestEvent.Response.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	return serveFile(requestEvent, fs, cacheKey, path.Base(cacheKey))
+}
+
+// Delete the transforms of uploads along with them
+func deleteImageTransforms(pb *pocketbase.PocketBase) {
+	pb.OnRecordAfterDeleteSuccess("site_uploads").BindFunc(func(event *core.RecordEvent) error {
+		fs, err := pb.NewFilesystem()
+		if err != nil {
+			return err
+		}
+		defer fs.Close()
+
+		prefix := transformsPrefix(event.Record.GetString("site"), event.Record.GetString("file"))
+		if errs := fs.DeletePrefix(prefix); len(errs) > 0 {
+			pb.Logger().Warn("Failed to delete image transforms", "upload", event.Record.Id, "errors", errs)
+		}
+
+		return event.Next()
+	})
+}
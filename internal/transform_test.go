@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestParseImageTransform(t *testing.T) {
+	tests := []struct {
+		query string
+		name  string
+		want  *imageTransform
+	}{
+		{"w=640", "photo.jpg", &imageTransform{width: 640, fit: "contain", ext: ".jpg"}},
+		{"h=360", "photo.PNG", &imageTransform{height: 360, fit: "contain", ext: ".png"}},
+		{"w=640&h=360&fit=cover", "photo.jpg", &imageTransform{width: 640, height: 360, fit: "cover", ext: ".jpg"}},
+		{"w=640&fit=contain&fmt=webp", "photo.jpg", &imageTransform{width: 640, fit: "contain", ext: ".webp"}},
+		{"fmt=jpeg", "photo.png", &imageTransform{fit: "contain", ext: ".jpg"}},
+		{"fmt=jpg", "photo.png", &imageTransform{fit: "contain", ext: ".jpg"}},
+		{"fmt=png", "photo.jpg", &imageTransform{fit: "contain", ext: ".png"}},
+		{"w=0", "photo.jpg", nil},
+		{"w=-1", "photo.jpg", nil},
+		{"w=abc", "photo.jpg", nil},
+		{"h=1.5", "photo.jpg", nil},
+		{"w=640&fit=cover", "photo.jpg", nil},
+		{"h=360&fit=cover", "photo.jpg", nil},
+		{"w=640&fit=fill", "photo.jpg", nil},
+		{"fmt=gif", "photo.jpg", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseImageTransform(query, test.name)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("parseImageTransform(%q) = %+v, want error", test.query, *got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseImageTransform(%q) failed: %v", test.query, err)
+			}
+			if *got != *test.want {
+				t.Errorf("parseImageTransform(%q) = %+v, want %+v", test.query, *got, *test.want)
+			}
+		})
+	}
+}
+
+func TestIsAllowedImageSize(t *testing.T) {
+	collection := core.NewBaseCollection("sites")
+	collection.Fields.Add(&core.JSONField{Name: "image_sizes"})
+
+	site := core.NewRecord(collection)
+	site.Set("image_sizes", []string{"640x360", "1280x", " x200 "})
+
+	tests := []struct {
+		width  int
+		height int
+		want   bool
+	}{
+		{640, 360, true},
+		{1280, 0, true},
+		{0, 200, true},
+		{640, 0, false},
+		{0, 360, false},
+		{1280, 720, false},
+		{360, 640, false},
+		{0, 0, false},
+	}
+
+	for _, test := range tests {
+		if got := isAllowedImageSize(site, test.width, test.height); got != test.want {
+			t.Errorf("isAllowedImageSize(%d, %d) = %v, want %v", test.width, test.height, got, test.want)
+		}
+	}
+
+	empty := core.NewRecord(collection)
+	if isAllowedImageSize(empty, 640, 360) {
+		t.Error("isAllowedImageSize allowed a size on a site without image sizes")
+	}
+}
+
+func TestServeImageTransform(t *testing.T) {
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+
+	fixture.site.Set("image_sizes", []string{"10x", "10x10"})
+	if err := pb.Save(fixture.site); err != nil {
+		t.Fatal(err)
+	}
+
+	var data bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for x := range 40 {
+		for y := range 20 {
+			img.Set(x, y, color.RGBA{R: uint8(x * 6), A: 255})
+		}
+	}
+	if err := png.Encode(&data, img); err != nil {
+		t.Fatal(err)
+	}
+	upload := createTestRecord(t, pb, "site_uploads", map[string]any{
+		"site": fixture.site.Id,
+		"file": testFile(t, data.String(), "photo.png"),
+	})
+
+	// Only the header is decoded before refusing to transform it
+	data.Reset()
+	if err := png.Encode(&data, image.NewGray(image.Rect(0, 0, 5000, 4000))); err != nil {
+		t.Fatal(err)
+	}
+	large := createTestRecord(t, pb, "site_uploads", map[string]any{
+		"site": fixture.site.Id,
+		"file": testFile(t, data.String(), "large.png"),
+	})
+
+	if err := ServeSites(pb); err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestHandler(t, pb)
+
+	response := serveTestRequest(handler, "GET", "http://example.com/_uploads/"+large.GetString("file")+"?w=10", nil)
+	if response.Code != 400 {
+		t.Errorf("transform of a %d pixel image: status = %d, want 400", 5000*4000, response.Code)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		width  int
+		height int
+	}{
+		{"w=10", 200, 10, 5},
+		{"w=10&h=10&fit=cover", 200, 10, 10},
+		{"w=20", 400, 0, 0},
+		{"w=10&h=10&fit=stretch", 400, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			target := "http://example.com/_uploads/" + upload.GetString("file") + "?" + test.query
+			response := serveTestRequest(handler, "GET", target, nil)
+			if response.Code != test.status {
+				t.Fatalf("status = %d, want %d", response.Code, test.status)
+			}
+			if test.status != 200 {
+				return
+			}
+
+			config, err := png.DecodeConfig(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Width != test.width || config.Height != test.height {
+				t.Errorf("size = %dx%d, want %dx%d", config.Width, config.Height, test.width, test.height)
+			}
+		})
+	}
+}
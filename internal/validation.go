@@ -19,6 +19,9 @@ func RegisterValidation(pb *pocketbase.PocketBase) error {
 		return err
 	}
 
+	pb.OnRecordValidate("pages").BindFunc(validatePageTree)
+	pb.OnRecordValidate("site_feeds").BindFunc(validateFeed)
+
 	pb.OnRecordValidate().BindFunc(func(event *core.RecordEvent) error {
 		var err error
 
@@ -56,6 +59,13 @@ func RegisterValidation(pb *pocketbase.PocketBase) error {
 				}
 			}
 
+			if field.Type() == "date" {
+				// Date fields are validated as strings like in the API
+				if val, ok := value.(types.DateTime); ok {
+					value = val.String()
+				}
+			}
+
 			if field.Type() == "file" {
 				// File fields are validated as strings of filenames
 				switch val := value.(type) {
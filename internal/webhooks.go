@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	webhookPending   = "pending"
+	webhookSucceeded = "succeeded"
+	webhookFailed    = "failed"
+)
+
+// Number of attempts to deliver an event before the delivery is marked failed
+const maxWebhookAttempts = 8
+
+// Delay before the first retry, doubled for every further retry up to the maximum
+const (
+	webhookRetryDelay    = 30 * time.Second
+	maxWebhookRetryDelay = 6 * time.Hour
+)
+
+// Time between checks for deliveries that are due, in case a wake up was missed
+const webhookPollInterval = 15 * time.Second
+
+// Deliveries are kept in the log for this long
+const webhookLogRetention = 30 * 24 * time.Hour
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Wakes the deliverer up when a delivery has been stored
+var webhookWake = make(chan struct{}, 1)
+
+// webhookSource describes a collection whose changes are sent to webhooks
+type webhookSource struct {
+	// Prefix of the event names, as in "page.created"
+	kind string
+	// Relation fields leading to the record that belongs to the site
+	path []string
+}
+
+var webhookSources = map[string]webhookSource{
+	"pages":                     {"page", nil},
+	"site_symbols":              {"symbol", nil},
+	"site_entries":              {"entry", []string{"field"}},
+	"site_symbol_entries":       {"entry", []string{"field", "symbol"}},
+	"page_entries":              {"entry", []string{"page"}},
+	"page_section_entries":      {"entry", []string{"section", "page"}},
+	"page_type_entries":         {"entry", []string{"field", "page_type"}},
+	"page_type_section_entries": {"entry", []string{"section", "page_type"}},
+}
+
+type webhookPayload struct {
+	Event   string    `json:"event"`
+	Site    string    `json:"site"`
+	Created time.Time `json:"created"`
+	// The changed record or the publish job
+	Data any `json:"data"`
+}
+
+// Follow the relations of a record to the site it belongs to
+func recordSiteId(app core.App, record *core.Record, path []string) (string, error) {
+	current := record
+	for _, name := range path {
+		field, ok := current.Collection().Fields.GetByName(name).(*core.RelationField)
+		if !ok {
+			return "", fmt.Errorf("%s has no relation %q", current.Collection().Name, name)
+		}
+
+		parent, err := app.FindRecordById(field.CollectionId, current.GetString(name))
+		if err != nil {
+			return "", err
+		}
+		current = parent
+	}
+
+	return current.GetString("site"), nil
+}
+
+// Store a delivery for every enabled webhook of the site subscribed to the event. Deliveries are
+// stored with the app of the change, so that they are only sent if the change is saved.
+func emitWebhookEvent(app core.App, siteId string, event string, data any) error {
+	webhooks, err := app.FindAllRecords("webhooks", dbx.HashExp{"site": siteId, "enabled": true})
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	payload, err := json.Marshal(webhookPayload{
+		Event:   event,
+		Site:    siteId,
+		Created: time.Now().UTC(),
+		Data:    data,
+	})
+	if err != nil {
+		return err
+	}
+
+	collection, err := app.FindCollectionByNameOrId("webhook_deliveries")
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		events := webhook.GetStringSlice("events")
+		if len(events) > 0 && !slices.Contains(events, event) {
+			continue
+		}
+
+		delivery := core.NewRecord(collection)
+		delivery.Set("webhook", webhook.Id)
+		delivery.Set("event", event)
+		delivery.Set("payload", types.JSONRaw(payload))
+		delivery.Set("status", webhookPending)
+		delivery.Set("next_attempt", types.NowDateTime())
+		if err := app.Save(delivery); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Signature of a request body, sent as "sha256=<hex>" so that receivers can verify the sender
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookRetryAfter(attempts int) time.Duration {
+	delay := webhookRetryDelay
+	for range attempts - 1 {
+		delay *= 2
+		if delay >= maxWebhookRetryDelay {
+			return maxWebhookRetryDelay
+		}
+	}
+	return delay
+}
+
+// Send a delivery once, scheduling a retry if it fails
+func deliverWebhook(ctx context.Context, pb *pocketbase.PocketBase, delivery *core.Record) error {
+	webhook, err := pb.FindRecordById("webhooks", delivery.GetString("webhook"))
+	if err != nil {
+		return err
+	}
+
+	body, _ := delivery.Get("payload").(types.JSONRaw)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	statusCode, err := func() (int, error) {
+		request, err := http.NewRequestWithContext(ctx, "POST", webhook.GetString("url"), bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("User-Agent", "PalaCMS-Webhooks")
+		request.Header.Set("X-Palacms-Event", delivery.GetString("event"))
+		request.Header.Set("X-Palacms-Delivery", delivery.Id)
+		request.Header.Set("X-Palacms-Timestamp", timestamp)
+		request.Header.Set("X-Palacms-Signature", signWebhook(webhook.GetString("secret"), timestamp, body))
+
+		response, err := webhookClient.Do(request)
+		if err != nil {
+			return 0, err
+		}
+		defer response.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return response.StatusCode, fmt.Errorf("not OK response (got %d)", response.StatusCode)
+		}
+		return response.StatusCode, nil
+	}()
+	if err != nil && ctx.Err() != nil {
+		// Shutting down, the delivery is retried on next start
+		return nil
+	}
+
+	attempts := delivery.GetInt("attempts") + 1
+	delivery.Set("attempts", attempts)
+	delivery.Set("response_status", statusCode)
+	if err == nil {
+		delivery.Set("status", webhookSucceeded)
+		delivery.Set("error", "")
+		delivery.Set("delivered", types.NowDateTime())
+	} else if attempts >= maxWebhookAttempts {
+		delivery.Set("status", webhookFailed)
+		delivery.Set("error", err.Error())
+	} else {
+		delivery.Set("error", err.Error())
+		delivery.Set("next_attempt", types.NowDateTime().Add(webhookRetryAfter(attempts)))
+	}
+
+	return pb.Save(delivery)
+}
+
+// Send the deliveries that are due, oldest first
+func deliverDueWebhooks(ctx context.Context, pb *pocketbase.PocketBase) {
+	deliveries, err := pb.FindRecordsByFilter(
+		"webhook_deliveries",
+		"status = {:pending} && next_attempt <= {:now}",
+		"next_attempt",
+		100,
+		0,
+		dbx.Params{"pending": webhookPending, "now": types.NowDateTime().String()},
+	)
+	if err != nil {
+		pb.Logger().Error("Failed to find webhook deliveries", "error", err)
+		return
+	}
+
+	workers := newWorkerPool(ctx, 4)
+	for _, delivery := range deliveries {
+		workers.run(func() error {
+			if err := deliverWebhook(ctx, pb, delivery); err != nil {
+				pb.Logger().Warn("Failed to deliver webhook", "delivery", delivery.Id, "error", err)
+			}
+			return nil
+		})
+	}
+	workers.wait()
+}
+
+func RegisterWebhooks(pb *pocketbase.PocketBase) error {
+	for collection, source := range webhookSources {
+		send := func(event *core.RecordEvent, siteId string, action string) {
+			err := emitWebhookEvent(event.App, siteId, source.kind+"."+action, event.Record)
+			if err != nil {
+				pb.Logger().Warn("Failed to store webhook deliveries", "record", event.Record.Id, "error", err)
+			}
+		}
+
+		pb.OnRecordCreate(collection).BindFunc(func(event *core.RecordEvent) error {
+			if err := event.Next(); err != nil {
+				return err
+			}
+			if siteId, err := recordSiteId(event.App, event.Record, source.path); err == nil {
+				send(event, siteId, "created")
+			}
+			return nil
+		})
+
+		pb.OnRecordUpdate(collection).BindFunc(func(event *core.RecordEvent) error {
+			if err := event.Next(); err != nil {
+				return err
+			}
+			if siteId, err := recordSiteId(event.App, event.Record, source.path); err == nil {
+				send(event, siteId, "updated")
+			}
+			return nil
+		})
+
+		pb.OnRecordDelete(collection).BindFunc(func(event *core.RecordEvent) error {
+			// Parents may be deleted along with the record, so the site is found beforehand
+			siteId, siteErr := recordSiteId(event.App, event.Record, source.path)
+			if err := event.Next(); err != nil {
+				return err
+			}
+			if siteErr == nil {
+				send(event, siteId, "deleted")
+			}
+			return nil
+		})
+	}
+
+	// Deliveries outlive the changes that caused them and are only stopped on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	pb.OnTerminate().BindFunc(func(event *core.TerminateEvent) error {
+		cancel()
+		return event.Next()
+	})
+
+	pb.OnServe().BindFunc(func(serveEvent *core.ServeEvent) error {
+		go func() {
+			ticker := time.NewTicker(webhookPollInterval)
+			defer ticker.Stop()
+			for {
+				deliverDueWebhooks(ctx, pb)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				case <-webhookWake:
+				}
+			}
+		}()
+
+		if err := pb.Cron().Add(
+			"prune_palacms_webhook_deliveries",
+			"@daily",
+			func() {
+				_, err := pb.DB().Delete("webhook_deliveries", dbx.And(
+					dbx.NewExp("status != {:pending}", dbx.Params{"pending": webhookPending}),
+					dbx.NewExp("created < {:before}", dbx.Params{"before": types.NowDateTime().Add(-webhookLogRetention).String()}),
+				)).Execute()
+				if err != nil {
+					pb.Logger().Warn("Failed to prune webhook deliveries", "error", err)
+				}
+			},
+		); err != nil {
+			return err
+		}
+
+		return serveEvent.Next()
+	})
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/pocketbase/pocketbase/core"
+)
+
+func TestWebhookRules(t *testing.T) {
+	pb := newTestApp(t)
+	fixture := createTestSite(t, pb)
+	webhook := createTestRecord(t, pb, "webhooks", map[string]any{
+		"site": fixture.site.Id,
+		"url":  "https://example.com/hook",
+	})
+
+	for _, role := range []string{"editor", "developer"} {
+		user := createTestRecord(t, pb, "users", map[string]any{
+			"email":      role + "@example.com",
+			"password":   "password123",
+			"serverRole": role,
+		})
+		info := &core.RequestInfo{Auth: user}
+
+		collection := webhook.Collection()
+		for name, rule := range map[string]*string{"view": collection.ViewRule, "create": collection.CreateRule, "update": collection.UpdateRule} {
+			canAccess, err := pb.CanAccessRecord(webhook, info, rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := role == "developer"; canAccess != want {
+				t.Errorf("%s can %s: %v, want %v", role, name, canAccess, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Number of files copied or deleted at the same time while publishing
+func publishConcurrency() int {
+	count, err := strconv.Atoi(os.Getenv("PALA_PUBLISH_CONCURRENCY"))
+	if err != nil || count < 1 {
+		return 8
+	}
+	return count
+}
+
+// workerPool runs tasks with bounded concurrency. The first failing task cancels the
+// tasks that have not started yet, and the errors of all failed tasks are returned together.
+type workerPool struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	group  sync.WaitGroup
+
+	mutex sync.Mutex
+	errs  []error
+}
+
+func newWorkerPool(ctx context.Context, size int) *workerPool {
+	poolCtx, cancel := context.WithCancel(ctx)
+	return &workerPool{
+		parent: ctx,
+		ctx:    poolCtx,
+		cancel: cancel,
+		slots:  make(chan struct{}, size),
+	}
+}
+
+// Run the task once a worker is free, unless the pool has been cancelled
+func (w *workerPool) run(task func() error) {
+	select {
+	case w.slots <- struct{}{}:
+	case <-w.ctx.Done():
+		return
+	}
+	if w.ctx.Err() != nil {
+		<-w.slots
+		return
+	}
+
+	w.group.Add(1)
+	go func() {
+		defer func() {
+			<-w.slots
+			w.group.Done()
+		}()
+
+		if err := task(); err != nil {
+			w.mutex.Lock()
+			w.errs = append(w.errs, err)
+			w.mutex.Unlock()
+			w.cancel()
+		}
+	}()
+}
+
+// Wait for the started tasks to finish
+func (w *workerPool) wait() error {
+	w.group.Wait()
+	w.cancel()
+
+	if err := w.parent.Err(); err != nil {
+		// Tasks failing because of the cancellation add nothing to it
+		return err
+	}
+	return errors.Join(w.errs...)
+}
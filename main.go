@@ -54,6 +54,46 @@ func setup(pb *pocketbase.PocketBase) error {
 		return err
 	}
 
+	if err := internal.RegisterReleaseEndpoints(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterDeployTargets(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterWebhooks(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterRedirects(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterPreviewEndpoint(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterSearchEndpoint(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterPublishSchedules(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterSiteBundles(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterSiteClone(pb); err != nil {
+		return err
+	}
+
+	if err := internal.RegisterCommands(pb); err != nil {
+		return err
+	}
+
 	if err := internal.RegisterAdminApp(pb); err != nil {
 		return err
 	}
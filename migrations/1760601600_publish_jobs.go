@@ -0,0 +1,89 @@
+// Migration 1760601600 (2025-10-16): Add `publish_jobs` collection.
+//
+// Context:
+// - Publishing used to run synchronously inside the generate request, so large sites
+//   timed out and the editor had no feedback about the progress.
+//
+// What this does:
+// - Creates the `publish_jobs` collection that stores the status, per-phase progress,
+//   timing and final error of each publish. Jobs are only written by the server, but
+//   can be viewed (and subscribed to) by everyone who has access to the site.
+// - Only one job of a site is `running` at a time, also across processes like the CLI. Running
+//   jobs are updated at least every minute, jobs that are not are considered abandoned.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			collection := core.NewBaseCollection("publish_jobs")
+			collection.ListRule = types.Pointer(`(@request.auth.serverRole != "") || (@collection.site_role_assignments.user.id = @request.auth.id && @collection.site_role_assignments.site.id = site.id)`)
+			collection.ViewRule = collection.ListRule
+			collection.Fields.Add(
+				&core.RelationField{
+					Name:          "site",
+					CollectionId:  sites.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.SelectField{
+					Name:      "status",
+					Values:    []string{"queued", "running", "succeeded", "failed"},
+					MaxSelect: 1,
+					Required:  true,
+				},
+				&core.TextField{
+					Name: "phase",
+				},
+				&core.JSONField{
+					Name: "progress",
+				},
+				&core.TextField{
+					Name: "error",
+				},
+				&core.NumberField{
+					Name:    "attempts",
+					OnlyInt: true,
+				},
+				&core.DateField{
+					Name: "started",
+				},
+				&core.DateField{
+					Name: "finished",
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			collection.AddIndex("idx_publish_jobs_site_status", false, "`site`, `status`", "")
+
+			return app.Save(collection)
+		},
+		func(app core.App) error {
+			collection, err := app.FindCollectionByNameOrId("publish_jobs")
+			if err != nil {
+				return err
+			}
+
+			return app.Delete(collection)
+		},
+	)
+}
@@ -0,0 +1,101 @@
+// Migration 1760688000 (2025-10-17): Add `site_releases` collection and the live release of sites.
+//
+// Context:
+// - Publishing wrote directly into the served `sites/<host>/` prefix, so visitors could see a
+//   half-published site and a failed publish left it broken.
+//
+// What this does:
+// - Creates the `site_releases` collection. Each release stores a manifest of the published
+//   files, which themselves are stored once by content hash and shared between releases.
+// - Adds the `release` field to `sites`, pointing to the release that is currently served.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			jobs, err := app.FindCollectionByNameOrId("publish_jobs")
+			if err != nil {
+				return err
+			}
+
+			collection := core.NewBaseCollection("site_releases")
+			collection.ListRule = types.Pointer(`(@request.auth.serverRole != "") || (@collection.site_role_assignments.user.id = @request.auth.id && @collection.site_role_assignments.site.id = site.id)`)
+			collection.ViewRule = collection.ListRule
+			collection.Fields.Add(
+				&core.RelationField{
+					Name:          "site",
+					CollectionId:  sites.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.RelationField{
+					Name:         "job",
+					CollectionId: jobs.Id,
+					MaxSelect:    1,
+				},
+				&core.FileField{
+					Name:      "manifest",
+					MaxSelect: 1,
+					MaxSize:   100 << 20,
+					Protected: true,
+					Required:  true,
+				},
+				&core.NumberField{
+					Name:    "files",
+					OnlyInt: true,
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			if err := app.Save(collection); err != nil {
+				return err
+			}
+
+			sites.Fields.Add(&core.RelationField{
+				Name:         "release",
+				CollectionId: collection.Id,
+				MaxSelect:    1,
+			})
+
+			return app.Save(sites)
+		},
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("release")
+			if err := app.Save(sites); err != nil {
+				return err
+			}
+
+			collection, err := app.FindCollectionByNameOrId("site_releases")
+			if err != nil {
+				return err
+			}
+
+			return app.Delete(collection)
+		},
+	)
+}
@@ -0,0 +1,73 @@
+// Migration 1760774400 (2025-10-18): Add sitemap and robots.txt settings.
+//
+// Context:
+// - Publishing now emits `sitemap.xml` and `robots.txt` for every site.
+//
+// What this does:
+// - Adds `sitemap_exclude` and `sitemap_priority` to `pages` so that pages can be left out
+//   of the sitemap or given a priority.
+// - Adds `robots` to `sites` to replace the default robots.txt.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pages.Fields.Add(
+				&core.BoolField{
+					Name: "sitemap_exclude",
+				},
+				&core.NumberField{
+					Name: "sitemap_priority",
+					Min:  types.Pointer(0.0),
+					Max:  types.Pointer(1.0),
+				},
+			)
+			if err := app.Save(pages); err != nil {
+				return err
+			}
+
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.Add(&core.TextField{
+				Name: "robots",
+			})
+
+			return app.Save(sites)
+		},
+		func(app core.App) error {
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pages.Fields.RemoveByName("sitemap_exclude")
+			pages.Fields.RemoveByName("sitemap_priority")
+			if err := app.Save(pages); err != nil {
+				return err
+			}
+
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("robots")
+			return app.Save(sites)
+		},
+	)
+}
@@ -0,0 +1,111 @@
+// Migration 1760860800 (2025-10-19): Add `site_feeds` collection.
+//
+// Context:
+// - Blogs are built as pages whose child pages (or pages of a page type) are the posts,
+//   but there was no way to syndicate them.
+//
+// What this does:
+// - Creates the `site_feeds` collection. A feed takes its items either from the children of
+//   `parent_page` or from the pages of `page_type`, and reads the title, summary and date of
+//   each item from the page entries of the configured field keys.
+// - Feeds are validated to have exactly one of `parent_page` and `page_type`, and to be
+//   published to a directory no other feed of the site uses: the path of the parent page,
+//   or `slug` for feeds of a page type.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pageTypes, err := app.FindCollectionByNameOrId("page_types")
+			if err != nil {
+				return err
+			}
+
+			collection := core.NewBaseCollection("site_feeds")
+			collection.ListRule = types.Pointer(`(@request.auth.serverRole != "") || (@collection.site_role_assignments.user.id = @request.auth.id && @collection.site_role_assignments.site.id = site.id)`)
+			collection.ViewRule = collection.ListRule
+			collection.CreateRule = collection.ListRule
+			collection.UpdateRule = collection.ListRule
+			collection.DeleteRule = collection.ListRule
+			collection.Fields.Add(
+				&core.RelationField{
+					Name:          "site",
+					CollectionId:  sites.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.TextField{
+					Name:     "name",
+					Required: true,
+				},
+				&core.TextField{
+					Name:    "slug",
+					Pattern: `^[a-z0-9_-]*$`,
+				},
+				&core.RelationField{
+					Name:          "parent_page",
+					CollectionId:  pages.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+				},
+				&core.RelationField{
+					Name:          "page_type",
+					CollectionId:  pageTypes.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+				},
+				&core.TextField{
+					Name: "title_field",
+				},
+				&core.TextField{
+					Name: "summary_field",
+				},
+				&core.TextField{
+					Name: "date_field",
+				},
+				&core.NumberField{
+					Name:    "limit",
+					OnlyInt: true,
+					Min:     types.Pointer(0.0),
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+
+			return app.Save(collection)
+		},
+		func(app core.App) error {
+			collection, err := app.FindCollectionByNameOrId("site_feeds")
+			if err != nil {
+				return err
+			}
+
+			return app.Delete(collection)
+		},
+	)
+}
@@ -0,0 +1,104 @@
+// Migration 1760947200 (2025-10-20): Add `deploy_targets` collection.
+//
+// Context:
+// - Published files were only served by the CMS process itself.
+//
+// What this does:
+// - Creates the `deploy_targets` collection. After each publish, the released files are synced
+//   to every enabled target of the site and the outcome is stored on the target. Targets
+//   contain credentials and choose where the server writes, so they are only accessible to
+//   developers and superusers.
+// - `release` is the release last deployed to the target, of which only the changes are
+//   deployed next. It is kept when pruning releases, and cleared when `type` or `config`
+//   changes so that every file is deployed to the new location.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			releases, err := app.FindCollectionByNameOrId("site_releases")
+			if err != nil {
+				return err
+			}
+
+			collection := core.NewBaseCollection("deploy_targets")
+			collection.ListRule = types.Pointer(`@request.auth.serverRole = "developer"`)
+			collection.ViewRule = collection.ListRule
+			collection.CreateRule = collection.ListRule
+			collection.UpdateRule = collection.ListRule
+			collection.DeleteRule = collection.ListRule
+			collection.Fields.Add(
+				&core.RelationField{
+					Name:          "site",
+					CollectionId:  sites.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.TextField{
+					Name:     "name",
+					Required: true,
+				},
+				&core.SelectField{
+					Name:      "type",
+					Values:    []string{"directory", "sftp", "git", "s3"},
+					MaxSelect: 1,
+					Required:  true,
+				},
+				&core.JSONField{
+					Name: "config",
+				},
+				&core.BoolField{
+					Name: "enabled",
+				},
+				&core.SelectField{
+					Name:      "status",
+					Values:    []string{"succeeded", "failed"},
+					MaxSelect: 1,
+				},
+				&core.TextField{
+					Name: "error",
+				},
+				&core.DateField{
+					Name: "deployed",
+				},
+				&core.RelationField{
+					Name:         "release",
+					CollectionId: releases.Id,
+					MaxSelect:    1,
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+
+			return app.Save(collection)
+		},
+		func(app core.App) error {
+			collection, err := app.FindCollectionByNameOrId("deploy_targets")
+			if err != nil {
+				return err
+			}
+
+			return app.Delete(collection)
+		},
+	)
+}
@@ -0,0 +1,65 @@
+// Migration 1761033600 (2025-10-21): Add link check setting and report.
+//
+// Context:
+// - Publishing now checks the internal links and assets referenced by the published pages.
+//
+// What this does:
+// - Adds `link_check` to `sites` to choose whether broken links only warn (default) or fail
+//   the publish.
+// - Adds `broken_links` to `publish_jobs` to store the broken links found by the publish.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.Add(&core.SelectField{
+				Name:      "link_check",
+				Values:    []string{"warn", "fail"},
+				MaxSelect: 1,
+			})
+			if err := app.Save(sites); err != nil {
+				return err
+			}
+
+			jobs, err := app.FindCollectionByNameOrId("publish_jobs")
+			if err != nil {
+				return err
+			}
+
+			jobs.Fields.Add(&core.JSONField{
+				Name: "broken_links",
+			})
+			return app.Save(jobs)
+		},
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("link_check")
+			if err := app.Save(sites); err != nil {
+				return err
+			}
+
+			jobs, err := app.FindCollectionByNameOrId("publish_jobs")
+			if err != nil {
+				return err
+			}
+
+			jobs.Fields.RemoveByName("broken_links")
+			return app.Save(jobs)
+		},
+	)
+}
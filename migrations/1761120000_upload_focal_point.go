@@ -0,0 +1,58 @@
+// Migration 1761120000 (2025-10-22): Add focal point to site uploads.
+//
+// Context:
+// - Publishing now creates resized variants of uploaded images and rewrites the images of
+//   pages to use them.
+//
+// What this does:
+// - Adds `focal_x` and `focal_y` to `site_uploads`, the relative position of the part of the
+//   image to keep in view when it is cropped.
+//
+// Limits:
+// - The resized variants created when publishing keep the whole image, so the focal point does
+//   not change them, and it is not added to published pages since their sections are hydrated
+//   and must match the HTML rendered by the symbols. Images requested from `/_uploads/` with
+//   `fit=cover` are cropped around it.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			uploads, err := app.FindCollectionByNameOrId("site_uploads")
+			if err != nil {
+				return err
+			}
+
+			uploads.Fields.Add(
+				&core.NumberField{
+					Name: "focal_x",
+					Min:  types.Pointer(0.0),
+					Max:  types.Pointer(1.0),
+				},
+				&core.NumberField{
+					Name: "focal_y",
+					Min:  types.Pointer(0.0),
+					Max:  types.Pointer(1.0),
+				},
+			)
+			return app.Save(uploads)
+		},
+		func(app core.App) error {
+			uploads, err := app.FindCollectionByNameOrId("site_uploads")
+			if err != nil {
+				return err
+			}
+
+			uploads.Fields.RemoveByName("focal_x")
+			uploads.Fields.RemoveByName("focal_y")
+			return app.Save(uploads)
+		},
+	)
+}
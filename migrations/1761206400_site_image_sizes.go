@@ -0,0 +1,41 @@
+// Migration 1761206400 (2025-10-23): Add allowed image sizes to sites.
+//
+// Context:
+// - Sites now serve uploaded images resized on request, e.g. `/_uploads/<name>?w=640&h=360`.
+//
+// What this does:
+// - Adds `image_sizes` to `sites`, the list of sizes images can be requested in, such as
+//   "640x360", "640x" (width only) or "x360" (height only). Every size is stored once
+//   requested, so only listed sizes are served to keep the storage bounded.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.Add(&core.JSONField{
+				Name: "image_sizes",
+			})
+			return app.Save(sites)
+		},
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("image_sizes")
+			return app.Save(sites)
+		},
+	)
+}
@@ -0,0 +1,55 @@
+// Migration 1761292800 (2025-10-24): Add page scope to publish jobs.
+//
+// Context:
+// - Editors can now publish a single page, and optionally its children, without
+//   republishing the whole site.
+//
+// What this does:
+// - Adds `page` and `include_children` to `publish_jobs`, so that jobs resumed after a
+//   restart publish the same pages. Jobs without a page publish the whole site.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			jobs, err := app.FindCollectionByNameOrId("publish_jobs")
+			if err != nil {
+				return err
+			}
+
+			jobs.Fields.Add(
+				&core.RelationField{
+					Name:          "page",
+					CollectionId:  pages.Id,
+					CascadeDelete: false,
+					MaxSelect:     1,
+				},
+				&core.BoolField{
+					Name: "include_children",
+				},
+			)
+			return app.Save(jobs)
+		},
+		func(app core.App) error {
+			jobs, err := app.FindCollectionByNameOrId("publish_jobs")
+			if err != nil {
+				return err
+			}
+
+			jobs.Fields.RemoveByName("page")
+			jobs.Fields.RemoveByName("include_children")
+			return app.Save(jobs)
+		},
+	)
+}
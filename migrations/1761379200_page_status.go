@@ -0,0 +1,68 @@
+// Migration 1761379200 (2025-10-25): Add publish state to pages and preview secret to sites.
+//
+// Context:
+// - Pages can now be prepared ahead of time as drafts, which are left out when publishing,
+//   and shared through signed preview links that expire.
+//
+// What this does:
+// - Adds `status` to `pages`: "draft" pages are not published, "unlisted" pages are published
+//   but left out of the sitemap and feeds. Pages without a status are published as before.
+// - Adds the hidden `preview_secret` to `sites`, which signs the preview links of the site.
+//   It is generated on first use, and clearing it revokes every preview link of the site.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pages.Fields.Add(&core.SelectField{
+				Name:      "status",
+				Values:    []string{"draft", "published", "unlisted"},
+				MaxSelect: 1,
+			})
+			if err := app.Save(pages); err != nil {
+				return err
+			}
+
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.Add(&core.TextField{
+				Name:   "preview_secret",
+				Hidden: true,
+			})
+			return app.Save(sites)
+		},
+		func(app core.App) error {
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pages.Fields.RemoveByName("status")
+			if err := app.Save(pages); err != nil {
+				return err
+			}
+
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("preview_secret")
+			return app.Save(sites)
+		},
+	)
+}
@@ -0,0 +1,87 @@
+// Migration 1761465600 (2025-10-26): Add `redirects` collection.
+//
+// Context:
+// - Renaming or moving a page left its old URL returning 404.
+//
+// What this does:
+// - Creates the `redirects` collection of per-site rules, which are applied before looking up
+//   published files. A rule redirects the `source` path to `target` with status 301 or 302,
+//   or answers 410 Gone. Wildcard rules also match every path below the source, and ":splat"
+//   in the target is replaced by the rest of the path. Rules are created automatically
+//   (`automatic`) when the slug or parent of a page changes, and deleted again once a page is
+//   published at their source or below it.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			collection := core.NewBaseCollection("redirects")
+			collection.ListRule = types.Pointer(`(@request.auth.serverRole != "") || (@collection.site_role_assignments.user.id = @request.auth.id && @collection.site_role_assignments.site.id = site.id)`)
+			collection.ViewRule = collection.ListRule
+			collection.CreateRule = collection.ListRule
+			collection.UpdateRule = collection.ListRule
+			collection.DeleteRule = collection.ListRule
+			collection.Fields.Add(
+				&core.RelationField{
+					Name:          "site",
+					CollectionId:  sites.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.TextField{
+					Name:     "source",
+					Required: true,
+					Pattern:  `^/[^?#]*$`,
+				},
+				&core.TextField{
+					Name: "target",
+				},
+				&core.SelectField{
+					Name:      "status",
+					Values:    []string{"301", "302", "410"},
+					MaxSelect: 1,
+					Required:  true,
+				},
+				&core.BoolField{
+					Name: "wildcard",
+				},
+				&core.BoolField{
+					Name: "automatic",
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			collection.AddIndex("idx_redirects_site_source", true, "`site`, `source`", "")
+
+			return app.Save(collection)
+		},
+		func(app core.App) error {
+			collection, err := app.FindCollectionByNameOrId("redirects")
+			if err != nil {
+				return err
+			}
+
+			return app.Delete(collection)
+		},
+	)
+}
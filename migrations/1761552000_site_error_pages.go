@@ -0,0 +1,62 @@
+// Migration 1761552000 (2025-10-27): Add error and maintenance pages to sites.
+//
+// Context:
+// - Published sites answered missing paths with the generic error JSON of the API, and
+//   redirected visitors to the admin app when the home page was missing.
+//
+// What this does:
+// - Adds `not_found_page` to `sites`, a page of the site that is published as `404.html`
+//   and served for paths that do not exist.
+// - Adds `maintenance_page` to `sites`, published as `maintenance.html`, and `maintenance`
+//   to serve it with status 503 for every page while the site is under maintenance.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.Add(
+				&core.RelationField{
+					Name:         "not_found_page",
+					CollectionId: pages.Id,
+					MaxSelect:    1,
+				},
+				&core.RelationField{
+					Name:         "maintenance_page",
+					CollectionId: pages.Id,
+					MaxSelect:    1,
+				},
+				&core.BoolField{
+					Name: "maintenance",
+				},
+			)
+			return app.Save(sites)
+		},
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("not_found_page")
+			sites.Fields.RemoveByName("maintenance_page")
+			sites.Fields.RemoveByName("maintenance")
+			return app.Save(sites)
+		},
+	)
+}
@@ -0,0 +1,157 @@
+// Migration 1761638400 (2025-10-28): Add `webhooks` and `webhook_deliveries` collections.
+//
+// Context:
+// - Downstream systems such as search indexers, chat bots and CDN purgers need to know when
+//   content changes or a site is published.
+//
+// What this does:
+// - Creates the `webhooks` collection. Each webhook of a site receives the events it is
+//   subscribed to (all events when none are selected) as signed POST requests. Webhooks
+//   contain secrets and choose where the server sends requests, so they are only accessible
+//   to developers and superusers.
+// - Creates the `webhook_deliveries` collection, the log of the events sent to each webhook.
+//   Deliveries are only written by the server and retried with exponential backoff.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			events := []string{
+				"page.created", "page.updated", "page.deleted",
+				"entry.created", "entry.updated", "entry.deleted",
+				"symbol.created", "symbol.updated", "symbol.deleted",
+				"publish.started", "publish.succeeded", "publish.failed",
+			}
+
+			webhooks := core.NewBaseCollection("webhooks")
+			webhooks.ListRule = types.Pointer(`@request.auth.serverRole = "developer"`)
+			webhooks.ViewRule = webhooks.ListRule
+			webhooks.CreateRule = webhooks.ListRule
+			webhooks.UpdateRule = webhooks.ListRule
+			webhooks.DeleteRule = webhooks.ListRule
+			webhooks.Fields.Add(
+				&core.RelationField{
+					Name:          "site",
+					CollectionId:  sites.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.TextField{
+					Name: "name",
+				},
+				&core.URLField{
+					Name:     "url",
+					Required: true,
+				},
+				&core.TextField{
+					Name:                "secret",
+					AutogeneratePattern: `[a-zA-Z0-9]{40}`,
+				},
+				&core.SelectField{
+					Name:      "events",
+					Values:    events,
+					MaxSelect: len(events),
+				},
+				&core.BoolField{
+					Name: "enabled",
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			if err := app.Save(webhooks); err != nil {
+				return err
+			}
+
+			deliveries := core.NewBaseCollection("webhook_deliveries")
+			deliveries.ListRule = webhooks.ListRule
+			deliveries.ViewRule = deliveries.ListRule
+			deliveries.Fields.Add(
+				&core.RelationField{
+					Name:          "webhook",
+					CollectionId:  webhooks.Id,
+					CascadeDelete: true,
+					MaxSelect:     1,
+					Required:      true,
+				},
+				&core.TextField{
+					Name:     "event",
+					Required: true,
+				},
+				&core.JSONField{
+					Name: "payload",
+				},
+				&core.SelectField{
+					Name:      "status",
+					Values:    []string{"pending", "succeeded", "failed"},
+					MaxSelect: 1,
+					Required:  true,
+				},
+				&core.NumberField{
+					Name:    "attempts",
+					OnlyInt: true,
+				},
+				&core.NumberField{
+					Name:    "response_status",
+					OnlyInt: true,
+				},
+				&core.TextField{
+					Name: "error",
+				},
+				&core.DateField{
+					Name: "next_attempt",
+				},
+				&core.DateField{
+					Name: "delivered",
+				},
+				&core.AutodateField{
+					Name:     "created",
+					OnCreate: true,
+				},
+				&core.AutodateField{
+					Name:     "updated",
+					OnCreate: true,
+					OnUpdate: true,
+				},
+			)
+			deliveries.AddIndex("idx_webhook_deliveries_status_next_attempt", false, "`status`, `next_attempt`", "")
+
+			return app.Save(deliveries)
+		},
+		func(app core.App) error {
+			deliveries, err := app.FindCollectionByNameOrId("webhook_deliveries")
+			if err != nil {
+				return err
+			}
+			if err := app.Delete(deliveries); err != nil {
+				return err
+			}
+
+			webhooks, err := app.FindCollectionByNameOrId("webhooks")
+			if err != nil {
+				return err
+			}
+
+			return app.Delete(webhooks)
+		},
+	)
+}
@@ -0,0 +1,32 @@
+// Migration 1761724800 (2025-10-29): Add full-text search table for published sites.
+//
+// Context:
+// - Publishing now emits a search index of the pages of each site, which the public search
+//   endpoint queries.
+//
+// What this does:
+// - Creates the `_palacms_search` FTS5 table. It is not a collection, only a cache of the
+//   search index of the live release of each site, which is loaded into it on first search.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			_, err := app.DB().NewQuery(
+				"CREATE VIRTUAL TABLE IF NOT EXISTS `_palacms_search` USING fts5(" +
+					"site UNINDEXED, url UNINDEXED, title, description, text, tokenize = 'unicode61 remove_diacritics 2')",
+			).Execute()
+			return err
+		},
+		func(app core.App) error {
+			_, err := app.DB().NewQuery("DROP TABLE IF EXISTS `_palacms_search`").Execute()
+			return err
+		},
+	)
+}
@@ -0,0 +1,72 @@
+// Migration 1761811200 (2025-10-30): Add publish schedules to sites and publish dates to pages.
+//
+// Context:
+// - Sites were only published when an editor did so, which made pages that should go live
+//   or be taken down at a given time depend on someone being around.
+//
+// What this does:
+// - Adds `publish_schedule` to `sites`, a cron expression evaluated in UTC on which the whole
+//   site is published, as in "0 6 * * *" for every morning.
+// - Adds `publish_at` and `unpublish_at` to `pages`. Pages are left out when publishing before
+//   `publish_at` and from `unpublish_at` on, like drafts, and published sites are published
+//   again once either date has passed.
+
+package migrations
+
+import (
+	"github.com/pocketbase/pocketbase/core"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+func init() {
+	m.Register(
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.Add(&core.TextField{
+				Name: "publish_schedule",
+			})
+			if err := app.Save(sites); err != nil {
+				return err
+			}
+
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pages.Fields.Add(
+				&core.DateField{
+					Name: "publish_at",
+				},
+				&core.DateField{
+					Name: "unpublish_at",
+				},
+			)
+			return app.Save(pages)
+		},
+		func(app core.App) error {
+			sites, err := app.FindCollectionByNameOrId("sites")
+			if err != nil {
+				return err
+			}
+
+			sites.Fields.RemoveByName("publish_schedule")
+			if err := app.Save(sites); err != nil {
+				return err
+			}
+
+			pages, err := app.FindCollectionByNameOrId("pages")
+			if err != nil {
+				return err
+			}
+
+			pages.Fields.RemoveByName("publish_at")
+			pages.Fields.RemoveByName("unpublish_at")
+			return app.Save(pages)
+		},
+	)
+}
@@ -8,7 +8,12 @@ export const Page = z.object({
 	page_type: z.string().nonempty(),
 	parent: z.string(),
 	site: z.string().nonempty(),
-	index: z.number().int().nonnegative()
+	index: z.number().int().nonnegative(),
+	sitemap_exclude: z.boolean().optional(),
+	sitemap_priority: z.number().min(0).max(1).optional(),
+	status: z.enum(['draft', 'published', 'unlisted', '']).optional(),
+	publish_at: z.string().optional(),
+	unpublish_at: z.string().optional()
 })
 
 export type Page = z.infer<typeof Page>
@@ -0,0 +1,13 @@
+import { z } from 'zod'
+
+export const Redirect = z.object({
+	id: z.string().nonempty(),
+	site: z.string().nonempty(),
+	source: z.string().regex(/^\/[^?#]*$/),
+	target: z.string(),
+	status: z.enum(['301', '302', '410']),
+	wildcard: z.boolean().optional(),
+	automatic: z.boolean().optional()
+})
+
+export type Redirect = z.infer<typeof Redirect>
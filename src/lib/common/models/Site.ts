@@ -9,7 +9,14 @@ export const Site = z.object({
 	head: z.string(),
 	foot: z.string(),
 	preview: z.string().or(z.file()).optional(),
-	index: z.number().int().nonnegative()
+	index: z.number().int().nonnegative(),
+	robots: z.string().optional(),
+	link_check: z.enum(['warn', 'fail', '']).optional(),
+	image_sizes: z.array(z.string().regex(/^\d*x\d*$/)).nullable().optional(),
+	not_found_page: z.string().optional(),
+	maintenance_page: z.string().optional(),
+	maintenance: z.boolean().optional(),
+	publish_schedule: z.string().optional()
 })
 
 export type Site = z.infer<typeof Site>
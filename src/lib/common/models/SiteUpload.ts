@@ -2,7 +2,14 @@ import { z } from 'zod'
 import { Upload } from './Upload'
 
 export const SiteUpload = Upload.extend({
-	site: z.string().nonempty()
+	site: z.string().nonempty(),
+	/**
+	 * Relative position of the part of the image to keep in view when it is cropped. Published variants keep the
+	 * whole image and published pages are not changed for it; the `fit=cover` transformations of `/_uploads/` crop
+	 * around it.
+	 */
+	focal_x: z.number().min(0).max(1).optional(),
+	focal_y: z.number().min(0).max(1).optional()
 })
 
 export type SiteUpload = z.infer<typeof SiteUpload>
@@ -23,6 +23,7 @@ import { PageEntry } from './PageEntry'
 import { SiteRoleAssignment } from './SiteRoleAssignment'
 import { SiteUpload } from './SiteUpload'
 import { LibraryUpload } from './LibraryUpload'
+import { Redirect } from './Redirect'
 
 /**
  * Model for each collection. Used in a PocketBase hook to validate records.
@@ -44,6 +45,7 @@ export const models = {
 	page_type_symbols: PageTypeSymbol,
 	page_types: PageType,
 	pages: Page,
+	redirects: Redirect,
 	site_entries: SiteEntry,
 	site_fields: SiteField,
 	site_groups: SiteGroup,
@@ -87,7 +87,7 @@ export const usePublishSite = (site_id?: string) => {
 			}
 
 			await Promise.all(promises)
-			await fetch(new URL('/api/palacms/generate', self.baseURL), {
+			const { job_id } = await fetch(new URL('/api/palacms/generate', self.baseURL), {
 				method: 'POST',
 				headers: {
 					'Content-Type': 'application/json',
@@ -98,10 +98,39 @@ export const usePublishSite = (site_id?: string) => {
 				if (!res.ok) {
 					throw new Error('Failed to generate site: Not OK response')
 				}
+				return res.json() as Promise<{ job_id: string }>
 			})
+			await wait_for_publish_job(job_id)
 		}
 	)
 
+	// Publishing runs in the background, wait until the job has finished
+	const wait_for_publish_job = async (job_id: string) => {
+		let unsubscribe: (() => Promise<void>) | undefined
+		try {
+			await new Promise<void>((resolve, reject) => {
+				const settle = (job: { status: string; error: string }) => {
+					if (job.status === 'succeeded') {
+						resolve()
+					} else if (job.status === 'failed') {
+						reject(new Error(`Failed to generate site: ${job.error}`))
+					}
+				}
+
+				self
+					.collection('publish_jobs')
+					.subscribe(job_id, ({ record }) => settle(record as any))
+					.then((fn) => {
+						unsubscribe = fn
+						return self.collection('publish_jobs').getOne(job_id)
+					})
+					.then((record) => settle(record as any), reject)
+			})
+		} finally {
+			await unsubscribe?.()
+		}
+	}
+
 	const generate_page = async (page: Page, no_js = false) => {
 		const locale = 'en' as const
 